@@ -26,22 +26,144 @@ SOFTWARE.
 package clamd
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+/*
+The status of a ScanResult: the verdict clamd gave, or RES_PARSE_ERROR for a
+reply line that isn't a scan result.
+*/
+type Status string
+
+const (
+	RES_OK          Status = "OK"
+	RES_FOUND       Status = "FOUND"
+	RES_ERROR       Status = "ERROR"
+	RES_EXCLUDED    Status = "Excluded"
+	RES_PARSE_ERROR Status = "PARSE ERROR"
+
+	// RES_SKIPPED is reported instead of FOUND for files clamd didn't scan
+	// completely because they exceeded a limit such as MaxFileSize, which
+	// clamd flags with a Heuristics.Limits.Exceeded signature when
+	// AlertExceedsMax is enabled.
+	RES_SKIPPED Status = "SKIPPED"
+)
+
+func (s Status) String() string {
+	return string(s)
+}
+
+// Replies to commands other than scans.
+const (
+	RES_PONG      = "PONG"
+	RES_RELOADING = "RELOADING"
+	RES_RELOADED  = "RELOADED"
+	RES_END       = "END"
+)
+
+// The commands sent to clamd.
 const (
-	RES_OK          = "OK"
-	RES_FOUND       = "FOUND"
-	RES_ERROR       = "ERROR"
-	RES_PARSE_ERROR = "PARSE ERROR"
+	CMD_PING            = "PING"
+	CMD_VERSION         = "VERSION"
+	CMD_VERSIONCOMMANDS = "VERSIONCOMMANDS"
+	CMD_RELOAD          = "RELOAD"
+	CMD_SHUTDOWN        = "SHUTDOWN"
+	CMD_SCAN            = "SCAN"
+	CMD_RAWSCAN         = "RAWSCAN"
+	CMD_CONTSCAN        = "CONTSCAN"
+	CMD_MULTISCAN       = "MULTISCAN"
+	CMD_ALLMATCHSCAN    = "ALLMATCHSCAN"
+	CMD_INSTREAM        = "INSTREAM"
+	CMD_FILDES          = "FILDES"
+	CMD_STREAM          = "STREAM"
+	CMD_STATS           = "STATS"
+	CMD_DETSTATSCLEAR   = "DETSTATSCLEAR"
+	CMD_IDSESSION       = "IDSESSION"
+	CMD_END             = "END"
 )
 
+/*
+A Clamd is a client for a clamd daemon. Commands dial a connection of their own
+and the client state shared between them is either fixed at construction or
+guarded by a mutex, so a Clamd is safe for concurrent use by multiple
+goroutines. PathMapper must be set before the client is shared.
+*/
 type Clamd struct {
+	network string
 	address string
+
+	// fallbacks are dialed in order when address can't be reached.
+	fallbacks []endpoint
+
+	chunkSize       int
+	readAhead       int
+	streamMaxLength int64
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	tlsConfig *tls.Config
+	keepAlive time.Duration
+
+	retryAttempts int
+	retryBackoff  time.Duration
+
+	eicarSignature string
+
+	onScanComplete func(ScanEvent)
+	clientID       string
+
+	logf func(format string, args ...any)
+
+	rawMu       sync.Mutex
+	rawResponse io.Writer
+
+	maxLineLength int
+
+	skipClean bool
+
+	pingResponse string
+	lenientPing  bool
+
+	idleTimeout time.Duration
+	pingOnReuse bool
+
+	dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	clock clock
+
+	nullTerminated bool
+	terminator     string
+
+	mu       sync.Mutex
+	sessions map[*Session]struct{}
+	commands []string
+
+	// PathMapper, when set, translates paths before they are sent to clamd.
+	// Use it when the client and the daemon see the same files under
+	// different names, e.g. C:\shared\x on the client and /mnt/shared/x on
+	// the daemon. Results carry the paths as clamd reports them, that is
+	// mapped.
+	PathMapper func(string) string
 }
 
 type Stats struct {
@@ -50,6 +172,70 @@ type Stats struct {
 	Threads  string
 	Memstats string
 	Queue    string
+
+	ThreadsLive        int
+	ThreadsIdle        int
+	ThreadsMax         int
+	ThreadsIdleTimeout int
+
+	// QueueItems is the number of queued items, QueueEntries the lines
+	// clamd lists below the QUEUE line for active and queued jobs.
+	QueueItems   int
+	QueueEntries []string
+
+	// QueueJobs holds the QueueEntries clamd reported timing for, showing how
+	// long each file has been scanning.
+	QueueJobs []QueueJob
+
+	Memory MemStats
+}
+
+/*
+A job listed below the QUEUE line of STATS, e.g. "SCAN 2.503017 /srv/big.iso".
+Elapsed is the time clamd has spent on it so far.
+*/
+type QueueJob struct {
+	Command string
+	Elapsed time.Duration
+	Path    string
+}
+
+func parseQueueJob(entry string) (QueueJob, bool) {
+	fields := strings.SplitN(entry, " ", 3)
+	if len(fields) < 2 {
+		return QueueJob{}, false
+	}
+
+	secs, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return QueueJob{}, false
+	}
+
+	job := QueueJob{
+		Command: fields[0],
+		Elapsed: time.Duration(secs * float64(time.Second)),
+	}
+
+	if len(fields) > 2 {
+		job.Path = fields[2]
+	}
+
+	return job, true
+}
+
+/*
+Memory usage as reported on the MEMSTATS line. Sizes are in megabytes; values
+clamd reports as N/A are left zero.
+*/
+type MemStats struct {
+	Heap       float64
+	Mmap       float64
+	Used       float64
+	Free       float64
+	Releasable float64
+	Pools      int
+	PoolsUsed  float64
+	PoolsTotal float64
 }
 
 type ScanResult struct {
@@ -58,254 +244,2895 @@ type ScanResult struct {
 	Path        string
 	Hash        string
 	Size        int
-	Status      string
+	Status      Status
+
+	// Signature is the name of the matched signature when Status is FOUND.
+	Signature string
+
+	// Reason is the limit that was reached, e.g. MaxFileSize, when Status
+	// is SKIPPED.
+	Reason string
+
+	// Signatures lists every signature matched for Path. AllMatchScanFileAll
+	// merges the FOUND lines clamd sends for the same file into one result,
+	// otherwise it holds just Signature.
+	Signatures []string
+
+	// Err is set, with Status ERROR, on a result that reports the
+	// connection to clamd failing before the response was complete, so
+	// the results before it may be truncated.
+	Err error
 }
 
-var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+/*
+Report whether the result found the data clean: OK and Excluded are clean,
+anything else, including ERROR, is not.
+*/
+func (r *ScanResult) IsClean() bool {
+	return r.Status == RES_OK || r.Status == RES_EXCLUDED
+}
+
+/*
+Totals for a multi-file scan, taken from the summary lines clamd ends the scan
+with. Counts the daemon doesn't report are counted from the results instead;
+Elapsed stays zero.
+*/
+type ScanSummary struct {
+	ScannedDirectories int
+	ScannedFiles       int
+	InfectedFiles      int
+	Errors             int
+	Elapsed            time.Duration
+}
 
-func (c *Clamd) newConnection() (conn *CLAMDConn, err error) {
+/*
+Passed to the WithOnScanComplete hook after every scan. Command is the clamd
+command used, e.g. SCAN or INSTREAM, and Path the path scanned, if any. Network
+and Address are where clamd was reached, which after a failover to one of
+WithFallbackAddresses is not the client's own address; they are empty if no
+connection could be made. LocalAddr is the client's end of that connection, to
+match the scan up with clamd's logs. ID is the one given with ContextWithScanID
+and Client the one set with WithClientID. Err is set when the scan could not be
+completed.
+*/
+type ScanEvent struct {
+	Command   string
+	Path      string
+	ID        string
+	Client    string
+	Network   string
+	Address   string
+	LocalAddr string
+	Duration  time.Duration
+	BytesSent int64
+	Results   []*ScanResult
+	Err       error
+}
 
-	var u *url.URL
+/*
+Record the connection the scan runs on.
+*/
+func (e *ScanEvent) connected(conn *CLAMDConn) {
+	e.Network, e.Address = conn.network, conn.address
 
-	if u, err = url.Parse(c.address); err != nil {
-		return
+	if addr := conn.LocalAddr(); addr != nil {
+		e.LocalAddr = addr.String()
 	}
+}
 
-	switch u.Scheme {
-	case "tcp":
-		conn, err = newCLAMDTcpConn(u.Host)
-	case "unix":
-		conn, err = newCLAMDUnixConn(u.Path)
-	default:
-		conn, err = newCLAMDUnixConn(c.address)
-	}
+type scanIDKey struct{}
 
-	return
+/*
+Tag the scans run with ctx with id, which is reported as the ID of their
+ScanEvent, e.g. to trace a request through to the scan it caused.
+*/
+func ContextWithScanID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scanIDKey{}, id)
 }
 
-func (c *Clamd) simpleCommand(command string) (chan *ScanResult, error) {
-	conn, err := c.newConnection()
-	if err != nil {
-		return nil, err
-	}
+type VersionInfo struct {
+	Raw             string
+	Engine          string
+	DatabaseVersion int
+	DatabaseTime    time.Time
+}
 
-	err = conn.sendCommand(command)
-	if err != nil {
-		return nil, err
-	}
+// ErrNilClient is returned by methods called on a nil *Clamd, or on one made
+// without NewClamd and so without an address.
+var ErrNilClient = errors.New("clamd: client not initialized")
 
-	ch, wg, err := conn.readResponse()
+// ErrStreamSizeExceeded is returned when a stream is larger than the
+// StreamMaxLength configured in clamd.conf.
+var ErrStreamSizeExceeded = errors.New("clamd: INSTREAM size limit exceeded")
 
-	go func() {
-		wg.Wait()
-		conn.Close()
-	}()
+/*
+A ClamdError is an ERROR reply from clamd about a path, such as a file it
+could not read, as opposed to a failure to talk to clamd at all. Path is the
+file the error was reported for, which for a directory scan is the file below
+the directory that failed.
+*/
+type ClamdError struct {
+	Path    string
+	Message string
+	Raw     string
+}
 
-	return ch, err
+func newClamdError(res *ScanResult) *ClamdError {
+	return &ClamdError{
+		Path:    res.Path,
+		Message: res.Description,
+		Raw:     res.Raw,
+	}
+}
+
+func (e *ClamdError) Error() string {
+	if e.pathNotVisible() {
+		return fmt.Sprintf("clamd: %s: %s (the path is not visible to clamd; use Scan or ScanStream when clamd runs on another host)", e.Path, e.Message)
+	}
+
+	return fmt.Sprintf("clamd: %s: %s", e.Path, e.Message)
 }
 
 /*
-Check the daemon's state (should reply with PONG).
+Unwrap returns ErrPathNotVisible when clamd could not find the path, and
+fs.ErrPermission when clamd was not allowed to read it, so callers can test for
+them with errors.Is.
 */
-func (c *Clamd) Ping() error {
-	ch, err := c.simpleCommand("PING")
-	if err != nil {
-		return err
+func (e *ClamdError) Unwrap() error {
+	if e.pathNotVisible() {
+		return ErrPathNotVisible
 	}
 
-	select {
-	case s := (<-ch):
-		switch s.Raw {
-		case "PONG":
-			return nil
-		default:
-			return errors.New(fmt.Sprintf("Invalid response, got %s.", s))
-		}
+	if strings.Contains(e.Message, "Access denied") || strings.Contains(e.Message, "Permission denied") {
+		return fs.ErrPermission
 	}
 
 	return nil
 }
 
+func (e *ClamdError) pathNotVisible() bool {
+	return strings.HasPrefix(e.Message, "lstat() failed") && strings.Contains(e.Message, "No such file")
+}
+
+// ErrPathNotVisible is wrapped by the *ClamdError returned when clamd can't
+// find a path it was asked to scan, typically because clamd runs on another
+// host and doesn't share the client's filesystem.
+var ErrPathNotVisible = errors.New("clamd: path not visible to clamd")
+
+// ErrAccessDenied is returned when clamd refuses the client as a whole, rather
+// than a file being unreadable: the socket may not be connected to, or clamd
+// replied Access denied to the command. Files clamd can't read are reported
+// as a *ClamdError wrapping fs.ErrPermission instead.
+var ErrAccessDenied = errors.New("clamd: access denied")
+
 /*
-Print program and database versions.
+A failure to connect to clamd for lack of permission, e.g. on the Unix socket.
+It matches both ErrAccessDenied and the underlying error with errors.Is.
 */
-func (c *Clamd) Version() (chan *ScanResult, error) {
-	dataArrays, err := c.simpleCommand("VERSION")
-	return dataArrays, err
+type accessDeniedError struct {
+	err error
 }
 
+func (e *accessDeniedError) Error() string {
+	return ErrAccessDenied.Error() + ": " + e.err.Error()
+}
+
+func (e *accessDeniedError) Unwrap() []error {
+	return []error{ErrAccessDenied, e.err}
+}
+
+// ErrCommandTimeout is returned when clamd gave up waiting for the rest of a
+// command, replying COMMAND READ TIMED OUT, because the client sent it, or the
+// data following it, too slowly.
+var ErrCommandTimeout = errors.New("clamd: command read timed out")
+
+// ErrReadTimeout is returned when clamd sent nothing for longer than the
+// timeout set with WithReadTimeout.
+var ErrReadTimeout = errors.New("clamd: timed out waiting for clamd to reply")
+
+// ErrLineTooLong is returned when clamd sends a reply line longer than the
+// limit set with WithMaxResponseLineLength, MAX_LINE_LENGTH by default.
+var ErrLineTooLong = errors.New("clamd: reply line too long")
+
+// ErrChunkTooLarge is returned when streaming with a chunk size, set with
+// WithChunkSize, above MAX_CHUNK_SIZE.
+var ErrChunkTooLarge = errors.New("clamd: INSTREAM chunk too large")
+
+// ErrNoResponse is returned when clamd closes the connection without replying
+// to a command.
+var ErrNoResponse = errors.New("clamd: connection closed without a response")
+
+// ErrStreamNotTerminated is returned by ScanStreamRaw when its input ends
+// without the zero-length chunk that terminates an INSTREAM stream.
+var ErrStreamNotTerminated = errors.New("clamd: INSTREAM stream not terminated")
+
+// ErrNotGzip is returned by ScanStreamGzip when its input doesn't start with a
+// gzip header.
+var ErrNotGzip = errors.New("clamd: input is not gzip compressed")
+
+// ErrFILDESUnsupported is returned by ScanFILDES when the connection to clamd
+// can't pass file descriptors.
+var ErrFILDESUnsupported = errors.New("clamd: FILDES requires a Unix socket connection")
+
+// EICAR_SIGNATURE is the name clamd reports for EICAR unless configured
+// otherwise with WithEICARSignature.
+const EICAR_SIGNATURE = "Eicar-Test-Signature"
+
+var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
 /*
-On this command clamd provides statistics about the scan queue, contents of scan
-queue, and memory usage. The exact reply format is subject to changes in future
-releases.
+Dial clamd, retrying failed dials as configured by WithRetry.
 */
-func (c *Clamd) Stats() (*Stats, error) {
-	ch, err := c.simpleCommand("STATS")
+func (c *Clamd) newConnection(ctx context.Context) (conn *CLAMDConn, err error) {
+	backoff := c.retryBackoff
+
+	for attempt := 1; ; attempt++ {
+		conn, err = c.dial(ctx)
+		if err == nil || attempt >= c.retryAttempts {
+			break
+		}
+
+		select {
+		case <-c.getClock().After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+
+		backoff *= 2
+	}
+
 	if err != nil {
-		return nil, err
+		return
 	}
 
-	stats := &Stats{}
+	if c.keepAlive > 0 {
+		conn.setKeepAlive(c.keepAlive)
+	}
 
-	for s := range ch {
-		if strings.HasPrefix(s.Raw, "POOLS") {
-			stats.Pools = strings.Trim(s.Raw[6:], " ")
-		} else if strings.HasPrefix(s.Raw, "STATE") {
-			stats.State = s.Raw
-		} else if strings.HasPrefix(s.Raw, "THREADS") {
-			stats.Threads = s.Raw
-		} else if strings.HasPrefix(s.Raw, "QUEUE") {
-			stats.Queue = s.Raw
-		} else if strings.HasPrefix(s.Raw, "MEMSTATS") {
-			stats.Memstats = s.Raw
-		} else if strings.HasPrefix(s.Raw, "END") {
-		} else {
-			//	return nil, errors.New(fmt.Sprintf("Unknown response, got %s.", s))
-		}
+	conn.readTimeout = c.readTimeout
+	conn.writeTimeout = c.writeTimeout
+	conn.nullTerminated = c.nullTerminated
+	conn.terminator = c.terminator
+	conn.logf = c.logf
+	conn.maxLineLength = c.maxLineLength
+
+	if c.rawResponse != nil {
+		conn.raw = c.writeRaw
 	}
 
-	return stats, nil
+	conn.watch(ctx)
+	return
 }
 
 /*
-Reload the databases.
+A network and address clamd may be dialed at.
 */
-func (c *Clamd) Reload() error {
-	ch, err := c.simpleCommand("RELOAD")
-	if err != nil {
-		return err
-	}
+type endpoint struct {
+	network string
+	address string
+}
 
-	select {
-	case s := (<-ch):
-		switch s.Raw {
-		case "RELOADING":
-			return nil
-		default:
-			return errors.New(fmt.Sprintf("Invalid response, got %s.", s))
+/*
+Dial the client's address and, while that fails to connect, its fallbacks in
+order. Once one connects the command runs there, whatever clamd replies.
+*/
+func (c *Clamd) dial(ctx context.Context) (*CLAMDConn, error) {
+	conn, err := c.dialEndpoint(ctx, c.network, c.address)
+
+	for _, e := range c.fallbacks {
+		if err == nil || ctx.Err() != nil {
+			break
 		}
+
+		conn, err = c.dialEndpoint(ctx, e.network, e.address)
 	}
 
-	return nil
+	return conn, err
 }
 
-func (c *Clamd) Shutdown() error {
-	_, err := c.simpleCommand("SHUTDOWN")
+/*
+Copy a reply line to the writer set with WithRawResponse, one whole line at a
+time however many connections are reading.
+*/
+func (c *Clamd) writeRaw(line string) {
+	c.rawMu.Lock()
+	defer c.rawMu.Unlock()
+
+	io.WriteString(c.rawResponse, line+"\n")
+}
+
+func (c *Clamd) dialEndpoint(ctx context.Context, network, address string) (*CLAMDConn, error) {
+	tlsConfig := c.tlsConfig
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "tls":
+		network = "tcp"
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	case "unix", "unixpacket":
+		tlsConfig = nil
+	default:
+		return nil, errors.New(fmt.Sprintf("clamd: unsupported network %q", network))
+	}
+
+	ctx, cancel := c.withDialTimeout(ctx, network)
+	defer cancel()
+
+	conn, err := c.dialContext(ctx, network, address)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, &accessDeniedError{err: err}
+	}
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return err
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	return &CLAMDConn{Conn: conn, network: network, address: address}, nil
 }
 
 /*
-Scan file or directory (recursively) with archive support enabled (a full path is
-required).
+Whether network is one of the Unix socket networks.
 */
-func (c *Clamd) ScanFile(path string) (chan *ScanResult, error) {
-	command := fmt.Sprintf("SCAN %s", path)
-	ch, err := c.simpleCommand(command)
-	return ch, err
+func isUnixNetwork(network string) bool {
+	return network == "unix" || network == "unixpacket"
 }
 
 /*
-Scan file or directory (recursively) with archive and special file support disabled
-(a full path is required).
+Every connection to clamd is made here, with the function set by WithDialer if
+any, so tests and proxies only have to replace this one dialer.
 */
-func (c *Clamd) RawScanFile(path string) (chan *ScanResult, error) {
-	command := fmt.Sprintf("RAWSCAN %s", path)
-	ch, err := c.simpleCommand(command)
-	return ch, err
+func (c *Clamd) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.dialer != nil {
+		return c.dialer(ctx, network, address)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
 }
 
 /*
-Scan file in a standard way or scan directory (recursively) using multiple threads
-(to make the scanning faster on SMP machines).
+Bound dialing, including any TLS handshake, by the timeout set with
+WithDialTimeout. TCP dials give up after TCP_TIMEOUT by default.
 */
-func (c *Clamd) MultiScanFile(path string) (chan *ScanResult, error) {
-	command := fmt.Sprintf("MULTISCAN %s", path)
-	ch, err := c.simpleCommand(command)
-	return ch, err
+func (c *Clamd) withDialTimeout(ctx context.Context, network string) (context.Context, context.CancelFunc) {
+	timeout := c.dialTimeout
+	if timeout <= 0 && !isUnixNetwork(network) {
+		timeout = TCP_TIMEOUT
+	}
+
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
 
 /*
-Scan file or directory (recursively) with archive support enabled and don’t stop
-the scanning when a virus is found.
+Split an address into the network and address to dial. tcp://host:port,
+tls://host:port and unix:///path are honored explicitly, a path starting with /
+is a Unix socket and a bare host:port is TCP, with IPv6 hosts in brackets as
+in [::1]:3310. Names starting with @, optionally as unix://@name, are Linux
+abstract Unix sockets. Anything else is treated as a Unix socket path.
 */
-func (c *Clamd) ContScanFile(path string) (chan *ScanResult, error) {
-	command := fmt.Sprintf("CONTSCAN %s", path)
-	ch, err := c.simpleCommand(command)
-	return ch, err
+func parseAddress(address string) (network string, addr string) {
+	// Linux abstract socket names, which may contain colons.
+	if strings.HasPrefix(address, "@") || strings.HasPrefix(address, "\x00") {
+		return "unix", address
+	}
+
+	if name, ok := strings.CutPrefix(address, "unix://@"); ok {
+		return "unix", "@" + name
+	}
+
+	if u, err := url.Parse(address); err == nil {
+		switch u.Scheme {
+		case "tcp":
+			return "tcp", hostPort(u)
+		case "tls":
+			return "tls", hostPort(u)
+		case "unix":
+			return "unix", u.Path
+		}
+	}
+
+	if strings.HasPrefix(address, "/") {
+		return "unix", address
+	}
+
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return "tcp", address
+	}
+
+	return "unix", address
 }
 
 /*
-Scan file or directory (recursively) with archive support enabled and don’t stop
-the scanning when a virus is found.
+The host:port of a tcp:// or tls:// URL, defaulting to DEFAULT_PORT. IPv6
+literals keep their brackets, e.g. [::1]:3310.
 */
-func (c *Clamd) AllMatchScanFile(path string) (chan *ScanResult, error) {
-	command := fmt.Sprintf("ALLMATCHSCAN %s", path)
-	ch, err := c.simpleCommand(command)
-	return ch, err
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), DEFAULT_PORT)
 }
 
 /*
-Scan a stream of data. The stream is sent to clamd in chunks, after INSTREAM,
-on the same socket on which the command was sent. This avoids the overhead
-of establishing new TCP connections and problems with NAT. The format of the
-chunk is: <length><data> where <length> is the size of the following data in
-bytes expressed as a 4 byte unsigned integer in network byte order and <data> is
-the actual chunk. Streaming is terminated by sending a zero-length chunk. Note:
-do not exceed StreamMaxLength as defined in clamd.conf, otherwise clamd will
-reply with INSTREAM size limit exceeded and close the connection
+Report a nil client or one without an address, so misconstructed clients fail
+with an error instead of a nil pointer dereference.
 */
-func (c *Clamd) ScanStream(r io.Reader, abort chan bool) (chan *ScanResult, error) {
-	conn, err := c.newConnection()
-	if err != nil {
-		return nil, err
+func (c *Clamd) validate() error {
+	if c == nil || c.address == "" {
+		return ErrNilClient
 	}
 
-	go func() {
-		for {
-			_, allowRunning := <-abort
-			if !allowRunning {
-				break
-			}
-		}
-		conn.Close()
-	}()
-
-	conn.sendCommand("INSTREAM")
+	return nil
+}
 
-	for {
-		buf := make([]byte, CHUNK_SIZE)
+func (c *Clamd) streamChunkSize() int {
+	if c.chunkSize <= 0 {
+		return CHUNK_SIZE
+	}
 
-		nr, err := r.Read(buf)
-		if nr > 0 {
-			conn.sendChunk(buf[0:nr])
-		}
+	return c.chunkSize
+}
 
-		if err != nil {
-			break
-		}
+/*
+Reject r up front when its size is known and over the StreamMaxLength set with
+WithStreamMaxLength, rather than have clamd cut the stream off part way.
+*/
+func (c *Clamd) checkStreamSize(r io.Reader) error {
+	if c.streamChunkSize() > MAX_CHUNK_SIZE {
+		return ErrChunkTooLarge
+	}
 
+	if c.streamMaxLength <= 0 {
+		return nil
 	}
 
-	err = conn.sendEOF()
-	if err != nil {
-		return nil, err
+	if size, ok := readerSize(r); ok && size > c.streamMaxLength {
+		return ErrStreamSizeExceeded
 	}
 
-	ch, wg, err := conn.readResponse()
+	return nil
+}
 
-	go func() {
+/*
+Wrap r in a buffer of the size set with WithReadAhead, if any.
+*/
+func (c *Clamd) readAheadReader(r io.Reader) io.Reader {
+	if c.readAhead <= 0 {
+		return r
+	}
+
+	return bufio.NewReaderSize(r, c.readAhead)
+}
+
+/*
+The number of bytes left in r, for readers that can tell without being read.
+*/
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len()), true
+	case interface{ Size() int64 }:
+		return v.Size(), true
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+
+		return fi.Size() - offset, true
+	}
+
+	return 0, false
+}
+
+func (c *Clamd) mapPath(path string) string {
+	if c.PathMapper == nil {
+		return path
+	}
+
+	return c.PathMapper(path)
+}
+
+func (c *Clamd) simpleCommand(ctx context.Context, command string) (chan *ScanResult, error) {
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return runCommand(conn, command)
+}
+
+/*
+Send command on conn and return the reply, closing conn once it has been read.
+*/
+func runCommand(conn *CLAMDConn, command string) (chan *ScanResult, error) {
+	err := conn.sendCommand(command)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ch, wg, err := conn.readResponse()
+
+	go func() {
 		wg.Wait()
 		conn.Close()
 	}()
 
-	return ch, nil
+	return ch, err
 }
 
-func NewClamd(address string) *Clamd {
-	clamd := &Clamd{address: address}
+/*
+Send command as is and return the reply, one result per line. This is an
+escape hatch for commands this package doesn't wrap: Raw holds each line as
+clamd sent it, and is only parsed as a scan result where it looks like one.
+*/
+func (c *Clamd) Command(command string) (chan *ScanResult, error) {
+	return c.CommandContext(context.Background(), command)
+}
+
+/*
+CommandContext is Command bounded by ctx.
+*/
+func (c *Clamd) CommandContext(ctx context.Context, command string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c.simpleCommand(ctx, command)
+}
+
+/*
+Send command and read the complete reply, closing the connection before
+returning.
+*/
+func (c *Clamd) commandLines(ctx context.Context, command string) ([]string, error) {
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := conn.sendCommand(command); err != nil {
+		return nil, err
+	}
+
+	ch, wg, _ := conn.readResponse()
+
+	var lines []string
+	for s := range ch {
+		if s.Err != nil {
+			err = s.Err
+			continue
+		}
+
+		lines = append(lines, s.Raw)
+	}
+
+	wg.Wait()
+
+	return lines, err
+}
+
+/*
+Called by scanCommand with what it doesn't deliver.
+*/
+type scanHooks struct {
+	// summary is called with each scan summary line.
+	summary func(line string)
+
+	// skipped is called with each clean result dropped by WithSkipClean.
+	skipped func(res *ScanResult)
+}
+
+/*
+Send the path scan command name for path. The END terminator and any scan
+summary lines are dropped, so only per-file results reach the channel, as are
+clean results with WithSkipClean; hooks, if set, are told about them. The
+channel is closed once the reply is complete: at END if clamd sends it, else
+when clamd closes the connection, after every result has been delivered.
+*/
+func (c *Clamd) scanCommand(ctx context.Context, name string, path string, hooks *scanHooks) (chan *ScanResult, error) {
+	event := ScanEvent{Command: name, Path: path}
+	start := c.now()
+
+	mapped := c.mapPath(path)
+
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return c.observe(ctx, event, start, nil, err)
+	}
+
+	event.connected(conn)
+
+	ch, err := runCommand(conn, fmt.Sprintf("%s %s", name, mapped))
+	if err != nil {
+		return c.observe(ctx, event, start, nil, err)
+	}
+
+	out := make(chan *ScanResult, 1)
+
+	go func() {
+		defer close(out)
+
+		for s := range ch {
+			if s.Status == RES_PARSE_ERROR && isSummaryLine(s.Raw) {
+				if hooks != nil && hooks.summary != nil {
+					hooks.summary(s.Raw)
+				}
+
+				// Nothing follows the terminator; don't wait for
+				// clamd to close the connection to end the results.
+				if s.Raw == RES_END {
+					conn.Close()
+					DrainResults(ch)
+					return
+				}
+				continue
+			}
+
+			s = withPathPrefix(s, mapped)
+
+			if c.skipClean && s.IsClean() {
+				if hooks != nil && hooks.skipped != nil {
+					hooks.skipped(s)
+				}
+				continue
+			}
+
+			if !forwardResult(ctx, ch, out, s) {
+				return
+			}
+		}
+	}()
+
+	return c.observe(ctx, event, start, out, nil)
+}
+
+/*
+The reply to a path scan starts with the path scanned, or a path below it.
+When that path itself contains ": " an error message may have been taken for
+part of it, so split it again after prefix.
+*/
+func withPathPrefix(res *ScanResult, prefix string) *ScanResult {
+	if res.Err != nil || !strings.Contains(prefix, ": ") || !strings.HasPrefix(res.Raw, prefix) || strings.HasPrefix(res.Path, prefix) {
+		return res
+	}
+
+	rest := res.Raw[len(prefix):]
+
+	i := strings.Index(rest, ": ")
+	if i < 0 {
+		return res
+	}
+
+	fixed := parseResult("-" + rest[i:])
+	if fixed.Status == RES_PARSE_ERROR {
+		return res
+	}
+
+	fixed.Raw = res.Raw
+	fixed.Path = prefix + rest[:i]
+	return fixed
+}
+
+/*
+Report a scan to the WithOnScanComplete hook once its results have all been
+received, passing them through unchanged.
+*/
+func (c *Clamd) observe(ctx context.Context, event ScanEvent, start time.Time, ch chan *ScanResult, err error) (chan *ScanResult, error) {
+	if c.onScanComplete == nil {
+		return ch, err
+	}
+
+	if err != nil {
+		event.Err = err
+		c.report(ctx, event, start)
+		return ch, err
+	}
+
+	out := make(chan *ScanResult, 1)
+
+	go func() {
+		for s := range ch {
+			if s.Err != nil {
+				event.Err = s.Err
+			}
+
+			event.Results = append(event.Results, s)
+
+			if !forwardResult(ctx, ch, out, s) {
+				event.Err = ctx.Err()
+				break
+			}
+		}
+
+		close(out)
+
+		c.report(ctx, event, start)
+	}()
+
+	return out, nil
+}
+
+/*
+observeResult is observe for scans with a single result, such as those run
+within a Session.
+*/
+func (c *Clamd) observeResult(ctx context.Context, event ScanEvent, start time.Time, res *ScanResult, err error) (*ScanResult, error) {
+	if res != nil {
+		event.Results = []*ScanResult{res}
+	}
+
+	if err != nil {
+		event.Err = err
+	} else if res != nil && res.Err != nil {
+		event.Err = res.Err
+	}
+
+	c.report(ctx, event, start)
+	return res, err
+}
+
+/*
+Pass a finished scan to the WithOnScanComplete hook, if any.
+*/
+func (c *Clamd) report(ctx context.Context, event ScanEvent, start time.Time) {
+	if c.onScanComplete == nil {
+		return
+	}
+
+	event.ID, _ = ctx.Value(scanIDKey{}).(string)
+	event.Client = c.clientID
+	event.Duration = c.since(start)
+
+	c.onScanComplete(event)
+}
+
+var summaryLabels = []string{
+	"Known viruses:",
+	"Engine version:",
+	"Scanned directories:",
+	"Scanned files:",
+	"Infected files:",
+	"Total errors:",
+	"Data scanned:",
+	"Data read:",
+	"Time:",
+	"Start Date:",
+	"End Date:",
+}
+
+func isSummaryLine(line string) bool {
+	if line == "" || line == RES_END || strings.HasPrefix(line, "-----") {
+		return true
+	}
+
+	for _, label := range summaryLabels {
+		if strings.HasPrefix(line, label) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Check the daemon's state (should reply with PONG).
+*/
+func (c *Clamd) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+/*
+PingContext is Ping bounded by ctx.
+*/
+func (c *Clamd) PingContext(ctx context.Context) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	lines, err := c.commandLines(ctx, CMD_PING)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if c.isPong(line) {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Invalid response, got %s.", strings.Join(lines, "\n")))
+}
+
+/*
+Whether line answers PING, as configured with WithPingResponse and
+WithLenientPing.
+*/
+func (c *Clamd) isPong(line string) bool {
+	if c.lenientPing {
+		return line != "" && line != "UNKNOWN COMMAND" && !strings.HasSuffix(line, " "+RES_ERROR.String())
+	}
+
+	if c.pingResponse != "" {
+		return line == c.pingResponse
+	}
+
+	return line == RES_PONG
+}
+
+/*
+Check that clamd is up and has a signature database loaded, for readiness
+probes. A daemon that answers PING but reports no database version would miss
+everything it scans, so it is reported unhealthy.
+*/
+func (c *Clamd) Healthcheck() error {
+	return c.HealthcheckContext(context.Background())
+}
+
+/*
+HealthcheckContext is Healthcheck bounded by ctx.
+*/
+func (c *Clamd) HealthcheckContext(ctx context.Context) error {
+	if err := c.PingContext(ctx); err != nil {
+		return err
+	}
+
+	version, err := c.VersionContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if version.DatabaseVersion == 0 {
+		return errors.New(fmt.Sprintf("No signature database loaded, got %s.", version.Raw))
+	}
+
+	return nil
+}
+
+/*
+Print program and database versions.
+*/
+func (c *Clamd) Version() (*VersionInfo, error) {
+	return c.VersionContext(context.Background())
+}
+
+/*
+VersionContext is Version bounded by ctx.
+*/
+func (c *Clamd) VersionContext(ctx context.Context) (*VersionInfo, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	line, err := c.firstLine(ctx, CMD_VERSION)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVersion(line), nil
+}
+
+/*
+VersionRaw is Version returning the reply lines as clamd sent them.
+*/
+func (c *Clamd) VersionRaw() ([]string, error) {
+	return c.VersionRawContext(context.Background())
+}
+
+/*
+VersionRawContext is VersionRaw bounded by ctx.
+*/
+func (c *Clamd) VersionRawContext(ctx context.Context) ([]string, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	lines, err := c.commandLines(ctx, CMD_VERSION)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 {
+		return nil, ErrNoResponse
+	}
+
+	return lines, nil
+}
+
+/*
+Print program and database versions, followed by the commands the daemon
+supports. Use it to check for optional commands such as FILDES or ALLMATCHSCAN
+before relying on them.
+*/
+func (c *Clamd) VersionCommands() (*VersionInfo, []string, error) {
+	return c.VersionCommandsContext(context.Background())
+}
+
+/*
+VersionCommandsContext is VersionCommands bounded by ctx.
+*/
+func (c *Clamd) VersionCommandsContext(ctx context.Context) (*VersionInfo, []string, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	line, err := c.firstLine(ctx, CMD_VERSIONCOMMANDS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, commands := line, ""
+	if i := strings.Index(line, "|"); i >= 0 {
+		version, commands = line[:i], line[i+1:]
+	}
+
+	commands = strings.TrimSpace(commands)
+	commands = strings.TrimPrefix(commands, "COMMANDS:")
+
+	return parseVersion(strings.TrimSpace(version)), strings.Fields(commands), nil
+}
+
+/*
+Send command and return the first line of the reply.
+*/
+func (c *Clamd) firstLine(ctx context.Context, command string) (string, error) {
+	ch, err := c.simpleCommand(ctx, command)
+	if err != nil {
+		return "", err
+	}
+
+	var line string
+	for s := range ch {
+		if s.Err != nil {
+			err = s.Err
+		} else if line == "" {
+			line = s.Raw
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if line == "" {
+		return "", ErrNoResponse
+	}
+
+	return line, nil
+}
+
+/*
+Parse a VERSION reply such as "ClamAV 0.103.8/26942/Tue Aug 15 07:53:06 2023".
+Daemons without a loaded database reply with just the engine version, leaving
+the database fields zero.
+*/
+func parseVersion(line string) *VersionInfo {
+	info := &VersionInfo{Raw: line}
+
+	fields := strings.SplitN(line, "/", 3)
+	info.Engine = strings.TrimSpace(fields[0])
+
+	if len(fields) > 1 {
+		if v, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			info.DatabaseVersion = v
+		}
+	}
+
+	if len(fields) > 2 {
+		info.DatabaseTime = parseDatabaseTime(strings.TrimSpace(fields[2]))
+	}
+
+	return info
+}
+
+/*
+clamd prints the database build time with ctime(3), but builds and wrappers
+have also used a zone name, RFC 1123 or ISO 8601.
+*/
+var databaseTimeFormats = []string{
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC1123,
+	time.RFC1123Z,
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+}
+
+/*
+Parse a database build time, in the local time zone when it has none, since
+ctime(3) prints the daemon's local time. Returns the zero time for formats it
+doesn't know.
+*/
+func parseDatabaseTime(value string) time.Time {
+	for _, format := range databaseTimeFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+/*
+How long ago the loaded signature database was built, for alerting when
+signatures go stale. The database time is taken to be in the local time zone
+when clamd doesn't say, so the age is only exact when clamd runs in the same
+zone as the client.
+*/
+func (c *Clamd) DatabaseAge() (time.Duration, error) {
+	return c.DatabaseAgeContext(context.Background())
+}
+
+/*
+DatabaseAgeContext is DatabaseAge bounded by ctx.
+*/
+func (c *Clamd) DatabaseAgeContext(ctx context.Context) (time.Duration, error) {
+	version, err := c.VersionContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if version.DatabaseTime.IsZero() {
+		return 0, errors.New(fmt.Sprintf("Invalid response, got %s.", version.Raw))
+	}
+
+	return c.since(version.DatabaseTime), nil
+}
+
+/*
+On this command clamd provides statistics about the scan queue, contents of scan
+queue, and memory usage. The exact reply format is subject to changes in future
+releases.
+*/
+func (c *Clamd) Stats() (*Stats, error) {
+	return c.StatsContext(context.Background())
+}
+
+/*
+StatsContext is Stats bounded by ctx.
+*/
+func (c *Clamd) StatsContext(ctx context.Context) (*Stats, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.simpleCommand(ctx, CMD_STATS)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for s := range ch {
+		if s.Err != nil {
+			err = s.Err
+			continue
+		}
+
+		lines = append(lines, s.Raw)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStats(lines), nil
+}
+
+/*
+Parse the lines of a STATS reply up to the END sentinel. Indented lines
+following QUEUE describe the jobs in the queue. The idle timeout is read from
+the THREADS line or, where clamd reports it separately, an IDLE TIMEOUT line.
+*/
+func parseStats(lines []string) *Stats {
+	stats := &Stats{}
+
+	inQueue := false
+
+	for _, line := range lines {
+		if line == RES_END {
+			break
+		}
+
+		if inQueue && (strings.HasPrefix(line, "\t") || strings.HasPrefix(line, " ")) {
+			entry := strings.TrimSpace(line)
+			stats.QueueEntries = append(stats.QueueEntries, entry)
+
+			if job, ok := parseQueueJob(entry); ok {
+				stats.QueueJobs = append(stats.QueueJobs, job)
+			}
+			continue
+		}
+
+		inQueue = false
+
+		if strings.HasPrefix(line, "POOLS:") {
+			stats.Pools = statsValue(line, "POOLS:")
+		} else if strings.HasPrefix(line, "STATE:") {
+			stats.State = statsValue(line, "STATE:")
+		} else if strings.HasPrefix(line, "THREADS:") {
+			stats.Threads = statsValue(line, "THREADS:")
+
+			for key, value := range statsPairs(stats.Threads) {
+				n, _ := strconv.Atoi(value)
+				switch key {
+				case "live":
+					stats.ThreadsLive = n
+				case "idle":
+					stats.ThreadsIdle = n
+				case "max":
+					stats.ThreadsMax = n
+				case "idle-timeout":
+					stats.ThreadsIdleTimeout = n
+				}
+			}
+		} else if strings.HasPrefix(line, "IDLE TIMEOUT:") {
+			stats.ThreadsIdleTimeout, _ = strconv.Atoi(statsValue(line, "IDLE TIMEOUT:"))
+		} else if strings.HasPrefix(line, "QUEUE:") {
+			stats.Queue = statsValue(line, "QUEUE:")
+			if fields := strings.Fields(stats.Queue); len(fields) > 0 {
+				stats.QueueItems, _ = strconv.Atoi(fields[0])
+			}
+
+			inQueue = true
+		} else if strings.HasPrefix(line, "MEMSTATS:") {
+			stats.Memstats = statsValue(line, "MEMSTATS:")
+
+			for key, value := range statsPairs(stats.Memstats) {
+				mb, _ := strconv.ParseFloat(strings.TrimSuffix(value, "M"), 64)
+				switch key {
+				case "heap":
+					stats.Memory.Heap = mb
+				case "mmap":
+					stats.Memory.Mmap = mb
+				case "used":
+					stats.Memory.Used = mb
+				case "free":
+					stats.Memory.Free = mb
+				case "releasable":
+					stats.Memory.Releasable = mb
+				case "pools":
+					stats.Memory.Pools, _ = strconv.Atoi(value)
+				case "pools_used":
+					stats.Memory.PoolsUsed = mb
+				case "pools_total":
+					stats.Memory.PoolsTotal = mb
+				}
+			}
+		}
+	}
+
+	return stats
+}
+
+func statsValue(line string, label string) string {
+	return strings.TrimSpace(strings.TrimPrefix(line, label))
+}
+
+/*
+Split "live 1  idle 0 max 12" into its label/value pairs.
+*/
+func statsPairs(value string) map[string]string {
+	pairs := map[string]string{}
+
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		pairs[fields[i]] = fields[i+1]
+	}
+
+	return pairs
+}
+
+/*
+Reset the detection statistics clamd keeps (DETSTATSCLEAR).
+*/
+func (c *Clamd) ClearDetectionStats() error {
+	return c.ClearDetectionStatsContext(context.Background())
+}
+
+/*
+ClearDetectionStatsContext is ClearDetectionStats bounded by ctx.
+*/
+func (c *Clamd) ClearDetectionStatsContext(ctx context.Context) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	ch, err := c.simpleCommand(ctx, CMD_DETSTATSCLEAR)
+	if err != nil {
+		return err
+	}
+
+	for s := range ch {
+		if s.Err != nil && err == nil {
+			err = s.Err
+		}
+	}
+
+	return err
+}
+
+/*
+Reload the databases.
+*/
+func (c *Clamd) Reload() error {
+	return c.ReloadContext(context.Background())
+}
+
+/*
+ReloadContext is Reload bounded by ctx.
+*/
+func (c *Clamd) ReloadContext(ctx context.Context) error {
+	_, err := c.ReloadResponseContext(ctx)
+	return err
+}
+
+/*
+ReloadResponse is Reload also returning what clamd replied, e.g. RELOADING, for
+tools that show it. The reply is returned even when it isn't an
+acknowledgement.
+*/
+func (c *Clamd) ReloadResponse() (string, error) {
+	return c.ReloadResponseContext(context.Background())
+}
+
+/*
+ReloadResponseContext is ReloadResponse bounded by ctx.
+*/
+func (c *Clamd) ReloadResponseContext(ctx context.Context) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+
+	lines, err := c.commandLines(ctx, CMD_RELOAD)
+	response := strings.Join(lines, "\n")
+
+	if err != nil {
+		return response, err
+	}
+
+	if len(lines) == 0 {
+		return "", ErrNoResponse
+	}
+
+	for _, line := range lines {
+		if isReloadAck(line) {
+			return response, nil
+		}
+	}
+
+	return response, errors.New(fmt.Sprintf("Invalid response, got %s.", response))
+}
+
+var statusCodeRegex = regexp.MustCompile(`^2\d\d\b`)
+
+/*
+clamd acknowledges RELOAD with RELOADING, but builds and proxies differ in case
+and whitespace, and some gateways answer with a 2xx status line instead.
+*/
+func isReloadAck(line string) bool {
+	line = strings.ToUpper(strings.TrimSpace(line))
+	return line == RES_RELOADING || line == RES_RELOADED || statusCodeRegex.MatchString(line)
+}
+
+/*
+Ask clamd to shut down. clamd accepts SHUTDOWN by closing the connection
+without a reply; Shutdown waits for that and returns an error if clamd answered
+instead, e.g. because the command is disabled.
+*/
+func (c *Clamd) Shutdown() error {
+	return c.ShutdownContext(context.Background())
+}
+
+/*
+ShutdownContext is Shutdown bounded by ctx.
+*/
+func (c *Clamd) ShutdownContext(ctx context.Context) error {
+	_, err := c.ShutdownResponseContext(ctx)
+	return err
+}
+
+/*
+ShutdownResponse is Shutdown also returning what clamd replied. The reply is
+empty when clamd accepted the command.
+*/
+func (c *Clamd) ShutdownResponse() (string, error) {
+	return c.ShutdownResponseContext(context.Background())
+}
+
+/*
+ShutdownResponseContext is ShutdownResponse bounded by ctx.
+*/
+func (c *Clamd) ShutdownResponseContext(ctx context.Context) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+
+	lines, err := c.commandLines(ctx, CMD_SHUTDOWN)
+	response := strings.Join(lines, "\n")
+
+	if err != nil {
+		return response, err
+	}
+
+	if len(lines) > 0 {
+		return response, errors.New(fmt.Sprintf("Invalid response, got %s.", response))
+	}
+
+	return "", nil
+}
+
+/*
+Scan file or directory (recursively) with archive support enabled (a full path is
+required). A directory scan stops at the first virus found; use ContScanFile to
+have every file scanned.
+
+The path is opened by clamd itself, so it must exist on the host clamd runs on;
+a path clamd can't find is reported with an ERROR result, which the *All
+variants return as a *ClamdError wrapping ErrPathNotVisible. Use Scan to stream
+the file instead when clamd is remote.
+*/
+func (c *Clamd) ScanFile(path string) (chan *ScanResult, error) {
+	return c.ScanFileContext(context.Background(), path)
+}
+
+/*
+ScanFileContext is ScanFile bounded by ctx.
+*/
+func (c *Clamd) ScanFileContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.scanCommand(ctx, CMD_SCAN, path, nil)
+	return ch, err
+}
+
+/*
+ScanFileResult is ScanFile for a single file, returning its verdict instead of
+a channel. An ERROR from clamd is returned along with its result as a
+*ClamdError. A clean result is returned even with WithSkipClean.
+*/
+func (c *Clamd) ScanFileResult(path string) (*ScanResult, error) {
+	return c.ScanFileResultContext(context.Background(), path)
+}
+
+/*
+ScanFileResultContext is ScanFileResult bounded by ctx.
+*/
+func (c *Clamd) ScanFileResultContext(ctx context.Context, path string) (*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	var clean *ScanResult
+
+	results, err := collectResults(c.scanCommand(ctx, CMD_SCAN, path, &scanHooks{
+		skipped: func(res *ScanResult) {
+			clean = res
+		},
+	}))
+
+	if len(results) > 0 {
+		return results[0], err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if clean == nil {
+		return nil, ErrNoResponse
+	}
+
+	return clean, nil
+}
+
+/*
+Scan file or directory (recursively) with archive and special file support disabled
+(a full path is required).
+*/
+func (c *Clamd) RawScanFile(path string) (chan *ScanResult, error) {
+	return c.RawScanFileContext(context.Background(), path)
+}
+
+/*
+RawScanFileContext is RawScanFile bounded by ctx.
+*/
+func (c *Clamd) RawScanFileContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.scanCommand(ctx, CMD_RAWSCAN, path, nil)
+	return ch, err
+}
+
+/*
+Scan file in a standard way or scan directory (recursively) using multiple threads
+(to make the scanning faster on SMP machines). Results arrive in the order
+clamd's threads finish the files, not in directory order, and the channel is
+only closed once clamd's reply is complete, so ranging over it sees them all.
+*/
+func (c *Clamd) MultiScanFile(path string) (chan *ScanResult, error) {
+	return c.MultiScanFileContext(context.Background(), path)
+}
+
+/*
+MultiScanFileContext is MultiScanFile bounded by ctx.
+*/
+func (c *Clamd) MultiScanFileContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.scanCommand(ctx, CMD_MULTISCAN, path, nil)
+	return ch, err
+}
+
+/*
+A ScanMode selects how ScanPath scans a directory.
+*/
+type ScanMode int
+
+const (
+	// SCAN_STOP_AT_FIRST stops at the first virus found, as SCAN does.
+	SCAN_STOP_AT_FIRST ScanMode = iota
+
+	// SCAN_CONTINUE scans every file, as CONTSCAN does.
+	SCAN_CONTINUE
+
+	// SCAN_MULTI scans every file using multiple threads, as MULTISCAN does.
+	SCAN_MULTI
+
+	// SCAN_ALL_MATCHES scans every file and reports every signature that
+	// matches each one, as ALLMATCHSCAN does.
+	SCAN_ALL_MATCHES
+)
+
+func (m ScanMode) command() string {
+	switch m {
+	case SCAN_CONTINUE:
+		return CMD_CONTSCAN
+	case SCAN_MULTI:
+		return CMD_MULTISCAN
+	case SCAN_ALL_MATCHES:
+		return CMD_ALLMATCHSCAN
+	}
+
+	return CMD_SCAN
+}
+
+/*
+Scan file or directory (recursively) with the command mode selects, returning
+every result once the scan has finished, as ScanFileAll does.
+*/
+func (c *Clamd) ScanPath(path string, mode ScanMode) ([]*ScanResult, error) {
+	return c.ScanPathContext(context.Background(), path, mode)
+}
+
+/*
+ScanPathContext is ScanPath bounded by ctx.
+*/
+func (c *Clamd) ScanPathContext(ctx context.Context, path string, mode ScanMode) ([]*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	results, err := collectResults(c.scanCommand(ctx, mode.command(), path, nil))
+	if mode == SCAN_ALL_MATCHES {
+		results = mergeMatches(results)
+	}
+
+	return results, err
+}
+
+/*
+Scan file or directory (recursively) with archive support enabled and don’t stop
+the scanning when a virus is found.
+*/
+func (c *Clamd) ContScanFile(path string) (chan *ScanResult, error) {
+	return c.ContScanFileContext(context.Background(), path)
+}
+
+/*
+ContScanFileContext is ContScanFile bounded by ctx.
+*/
+func (c *Clamd) ContScanFileContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.scanCommand(ctx, CMD_CONTSCAN, path, nil)
+	return ch, err
+}
+
+/*
+Scan file or directory (recursively) with archive support enabled and don’t stop
+the scanning when a virus is found.
+*/
+func (c *Clamd) AllMatchScanFile(path string) (chan *ScanResult, error) {
+	return c.AllMatchScanFileContext(context.Background(), path)
+}
+
+/*
+AllMatchScanFileContext is AllMatchScanFile bounded by ctx.
+*/
+func (c *Clamd) AllMatchScanFileContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.scanCommand(ctx, CMD_ALLMATCHSCAN, path, nil)
+	return ch, err
+}
+
+/*
+Scan an open file by passing its descriptor to clamd over the Unix socket, so
+the daemon reads the file directly instead of it being streamed. Only possible
+when clamd is reached over a local Unix socket.
+*/
+func (c *Clamd) ScanFILDES(f *os.File) (chan *ScanResult, error) {
+	return c.ScanFILDESContext(context.Background(), f)
+}
+
+/*
+ScanFILDESContext is ScanFILDES bounded by ctx.
+*/
+func (c *Clamd) ScanFILDESContext(ctx context.Context, f *os.File) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if !isUnixNetwork(c.network) {
+		return nil, ErrFILDESUnsupported
+	}
+
+	event := ScanEvent{Command: CMD_FILDES, Path: f.Name()}
+	start := c.now()
+	ch, err := c.scanFILDES(ctx, f, &event)
+	return c.observe(ctx, event, start, ch, err)
+}
+
+func (c *Clamd) scanFILDES(ctx context.Context, f *os.File, event *ScanEvent) (chan *ScanResult, error) {
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	event.connected(conn)
+
+	// A fallback reached over TCP can't be passed a descriptor either.
+	if !isUnixNetwork(conn.network) {
+		conn.Close()
+		return nil, ErrFILDESUnsupported
+	}
+
+	if err := conn.sendCommand(CMD_FILDES); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.sendFile(f); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ch, wg, err := conn.readResponse()
+
+	go func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	return ch, err
+}
+
+/*
+Verify clamd works end to end by streaming the EICAR test file and checking it
+is reported as infected with the expected signature.
+*/
+func (c *Clamd) SelfTest() error {
+	return c.SelfTestContext(context.Background())
+}
+
+/*
+SelfTestContext is SelfTest bounded by ctx.
+*/
+func (c *Clamd) SelfTestContext(ctx context.Context) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	signature := c.eicarSignature
+	if signature == "" {
+		signature = EICAR_SIGNATURE
+	}
+
+	ch, err := c.ScanStreamContext(ctx, bytes.NewReader(EICAR))
+	if err != nil {
+		return err
+	}
+
+	var res *ScanResult
+	for s := range ch {
+		if res == nil {
+			res = s
+		}
+	}
+
+	if res == nil {
+		return errors.New("No response from clamd.")
+	}
+
+	if res.Err != nil {
+		return res.Err
+	}
+
+	if res.Status != RES_FOUND || res.Description != signature {
+		return errors.New(fmt.Sprintf("Self test failed, expected %s %s, got %s.", signature, RES_FOUND, res.Raw))
+	}
+
+	return nil
+}
+
+/*
+Scan a local file using the fastest method available: FILDES when clamd is on a
+Unix socket and supports it, SCAN when clamd shares the filesystem (a Unix
+socket or a loopback address) and streaming the contents otherwise.
+*/
+func (c *Clamd) Scan(path string) (chan *ScanResult, error) {
+	return c.ScanContext(context.Background(), path)
+}
+
+/*
+ScanContext is Scan bounded by ctx.
+*/
+func (c *Clamd) ScanContext(ctx context.Context, path string) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if isUnixNetwork(c.network) && c.supports(ctx, CMD_FILDES) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// clamd holds its own copy of the descriptor once it is sent.
+		defer f.Close()
+
+		return c.ScanFILDESContext(ctx, f)
+	}
+
+	if c.sharesFilesystem() {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.ScanFileContext(ctx, abs)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return c.ScanStreamContext(ctx, f)
+}
+
+/*
+Whether clamd lists command in VERSIONCOMMANDS. The list is fetched once and
+kept; daemons that answer without one, e.g. with UNKNOWN COMMAND, are assumed
+to support nothing optional, which is kept too so they aren't asked again on
+every call. A failure to get any answer is not kept.
+*/
+func (c *Clamd) supports(ctx context.Context, command string) bool {
+	c.mu.Lock()
+	commands := c.commands
+	c.mu.Unlock()
+
+	if commands == nil {
+		// Only a reply is kept: clamd may just be restarting.
+		_, list, err := c.VersionCommandsContext(ctx)
+		if err != nil {
+			return false
+		}
+
+		if list == nil {
+			list = []string{}
+		}
+
+		c.mu.Lock()
+		c.commands = list
+		c.mu.Unlock()
+
+		commands = list
+	}
+
+	for _, cmd := range commands {
+		if cmd == command {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Whether clamd runs on this host and so can open our paths itself.
+*/
+func (c *Clamd) sharesFilesystem() bool {
+	if isUnixNetwork(c.network) {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(c.address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+Scan a stream of data. The stream is sent to clamd in chunks, after INSTREAM,
+on the same socket on which the command was sent. This avoids the overhead
+of establishing new TCP connections and problems with NAT. The format of the
+chunk is: <length><data> where <length> is the size of the following data in
+bytes expressed as a 4 byte unsigned integer in network byte order and <data> is
+the actual chunk. Streaming is terminated by sending a zero-length chunk. Note:
+do not exceed StreamMaxLength as defined in clamd.conf, otherwise clamd will
+reply with INSTREAM size limit exceeded and close the connection. That is
+returned as ErrStreamSizeExceeded if sending failed, or as the Err of the
+result if all of the stream was sent before clamd gave up.
+
+clamd only reports on a stream once it has received all of it. To stop sending
+early, e.g. once an earlier part of concatenated content was found infected,
+use ScanStreamContext or ScanStreamWithAbort.
+*/
+func (c *Clamd) ScanStream(r io.Reader, abort chan bool) (chan *ScanResult, error) {
+	ctx := context.Background()
+
+	if abort != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+
+		go func() {
+			for {
+				_, allowRunning := <-abort
+				if !allowRunning {
+					break
+				}
+			}
+			cancel()
+		}()
+	}
+
+	return c.ScanStreamContext(ctx, r)
+}
+
+/*
+ScanStreamTimeout is ScanStream giving up once d has passed. If clamd has not
+answered by then the connection is closed and the result carries the error.
+*/
+func (c *Clamd) ScanStreamTimeout(r io.Reader, d time.Duration) (chan *ScanResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+
+	ch, err := c.ScanStreamContext(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan *ScanResult, 1)
+
+	go func() {
+		defer cancel()
+		defer close(out)
+
+		for s := range ch {
+			if !forwardResult(ctx, ch, out, s) {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+/*
+ScanStreamContext is ScanStream bounded by ctx. Once ctx is done no further
+chunks are sent and the connection is closed.
+*/
+func (c *Clamd) ScanStreamContext(ctx context.Context, r io.Reader) (chan *ScanResult, error) {
+	ch, _, err := c.ScanStreamCountContext(ctx, r)
+	return ch, err
+}
+
+/*
+ScanStreamCount is ScanStream that also reports how many bytes of r were sent
+to clamd, including when streaming stopped part way, e.g. with
+ErrStreamSizeExceeded.
+*/
+func (c *Clamd) ScanStreamCount(r io.Reader) (chan *ScanResult, int64, error) {
+	return c.ScanStreamCountContext(context.Background(), r)
+}
+
+/*
+ScanStreamCountContext is ScanStreamCount bounded by ctx.
+*/
+func (c *Clamd) ScanStreamCountContext(ctx context.Context, r io.Reader) (chan *ScanResult, int64, error) {
+	if err := c.validate(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := c.checkStreamSize(r); err != nil {
+		return nil, 0, err
+	}
+
+	r = c.readAheadReader(r)
+
+	return c.instream(ctx, func(conn *CLAMDConn) (int64, error) {
+		return conn.sendStream(ctx, r, c.streamChunkSize())
+	})
+}
+
+/*
+Scan framed, which is already framed as INSTREAM data, e.g. passed through from
+a client of a proxy, without framing it again. framed must hold chunks of a
+4 byte length in network byte order followed by that many bytes of data, no
+more than MAX_CHUNK_SIZE each, ended with a zero-length chunk; the data is sent
+as is and anything after the zero-length chunk is not read. If framed ends
+before the zero-length chunk, ErrStreamNotTerminated is returned and clamd
+never scans the partial stream.
+*/
+func (c *Clamd) ScanStreamRaw(framed io.Reader) (chan *ScanResult, error) {
+	return c.ScanStreamRawContext(context.Background(), framed)
+}
+
+/*
+ScanStreamRawContext is ScanStreamRaw bounded by ctx.
+*/
+func (c *Clamd) ScanStreamRawContext(ctx context.Context, framed io.Reader) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ch, _, err := c.instream(ctx, func(conn *CLAMDConn) (int64, error) {
+		return conn.sendFramed(ctx, framed)
+	})
+
+	return ch, err
+}
+
+/*
+Open a connection, send an INSTREAM scan with send and return the results
+along with the number of bytes send reported sending.
+*/
+func (c *Clamd) instream(ctx context.Context, send func(conn *CLAMDConn) (int64, error)) (chan *ScanResult, int64, error) {
+	event := ScanEvent{Command: CMD_INSTREAM}
+	start := c.now()
+
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		_, err = c.observe(ctx, event, start, nil, err)
+		return nil, 0, err
+	}
+
+	event.connected(conn)
+
+	sent, err := send(conn)
+	event.BytesSent = sent
+
+	if err != nil {
+		conn.Close()
+		_, err = c.observe(ctx, event, start, nil, err)
+		return nil, sent, err
+	}
+
+	ch, wg, err := conn.readResponse()
+
+	go func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	ch, err = c.observe(ctx, event, start, ch, err)
+	return ch, sent, err
+}
+
+/*
+ScanStreamWithAbort is ScanStream that can be stopped early: once abort is
+closed no further chunks are sent and the connection to clamd is closed.
+*/
+func (c *Clamd) ScanStreamWithAbort(r io.Reader, abort <-chan struct{}) (chan *ScanResult, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ch, err := c.ScanStreamContext(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan *ScanResult, 1)
+
+	go func() {
+		defer cancel()
+		defer close(out)
+
+		for s := range ch {
+			if !forwardResult(ctx, ch, out, s) {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+/*
+Scan no more than the first max bytes of r, e.g. the header region of a large
+media file for a quick first pass. Whatever was sent is scanned as a complete
+stream.
+*/
+func (c *Clamd) ScanStreamLimited(r io.Reader, max int64) (chan *ScanResult, error) {
+	return c.ScanStreamLimitedContext(context.Background(), r, max)
+}
+
+/*
+ScanStreamLimitedContext is ScanStreamLimited bounded by ctx.
+*/
+func (c *Clamd) ScanStreamLimitedContext(ctx context.Context, r io.Reader, max int64) (chan *ScanResult, error) {
+	return c.ScanStreamContext(ctx, io.LimitReader(r, max))
+}
+
+/*
+Scan r, which the caller knows to be size bytes long, e.g. from an HTTP
+Content-Length. A size over the StreamMaxLength set with WithStreamMaxLength
+returns ErrStreamSizeExceeded without anything being sent; otherwise this is
+ScanStream.
+*/
+func (c *Clamd) ScanStreamSized(r io.Reader, size int64) (chan *ScanResult, error) {
+	return c.ScanStreamSizedContext(context.Background(), r, size)
+}
+
+/*
+ScanStreamSizedContext is ScanStreamSized bounded by ctx.
+*/
+func (c *Clamd) ScanStreamSizedContext(ctx context.Context, r io.Reader, size int64) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.streamMaxLength > 0 && size > c.streamMaxLength {
+		return nil, ErrStreamSizeExceeded
+	}
+
+	return c.ScanStreamContext(ctx, r)
+}
+
+/*
+Scan the decompressed contents of the gzip stream r, e.g. a gzipped artifact,
+rather than the compressed bytes. Returns ErrNotGzip if r isn't gzip; if r is
+cut short or corrupt part way the scan fails rather than scanning a truncated
+copy.
+*/
+func (c *Clamd) ScanStreamGzip(r io.Reader) (chan *ScanResult, error) {
+	return c.ScanStreamGzipContext(context.Background(), r)
+}
+
+/*
+ScanStreamGzipContext is ScanStreamGzip bounded by ctx.
+*/
+func (c *Clamd) ScanStreamGzipContext(ctx context.Context, r io.Reader) (chan *ScanResult, error) {
+	zr, err := gzip.NewReader(r)
+	if err == gzip.ErrHeader || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNotGzip
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+
+	return c.ScanStreamContext(ctx, zr)
+}
+
+/*
+Scan a stream using the legacy STREAM command, for old daemons without
+INSTREAM: clamd replies with a port to which the data is sent on a second
+connection, and reports the verdict on the first. Prefer ScanStream with any
+daemon that supports INSTREAM.
+*/
+func (c *Clamd) ScanStreamLegacy(r io.Reader) (chan *ScanResult, error) {
+	return c.ScanStreamLegacyContext(context.Background(), r)
+}
+
+/*
+ScanStreamLegacyContext is ScanStreamLegacy bounded by ctx.
+*/
+func (c *Clamd) ScanStreamLegacyContext(ctx context.Context, r io.Reader) (chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	event := ScanEvent{Command: CMD_STREAM}
+	start := c.now()
+	ch, err := c.scanStreamLegacy(ctx, r, &event)
+	return c.observe(ctx, event, start, ch, err)
+}
+
+func (c *Clamd) scanStreamLegacy(ctx context.Context, r io.Reader, event *ScanEvent) (chan *ScanResult, error) {
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	event.connected(conn)
+
+	if err := conn.sendCommand(CMD_STREAM); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	line, err := conn.readLine(conn.bufReader())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var port int
+	if _, err := fmt.Sscanf(line, "PORT %d", &port); err != nil {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("Invalid response, got %s.", line))
+	}
+
+	// The data port is opened on the host clamd runs on.
+	host := "127.0.0.1"
+	if h, _, err := net.SplitHostPort(conn.address); err == nil && !isUnixNetwork(conn.network) {
+		host = h
+	}
+
+	dataAddress := net.JoinHostPort(host, strconv.Itoa(port))
+
+	dialCtx, cancel := c.withDialTimeout(ctx, "tcp")
+	dc, err := c.dialContext(dialCtx, "tcp", dataAddress)
+	cancel()
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	data := &CLAMDConn{Conn: dc}
+
+	data.watch(ctx)
+
+	event.BytesSent, err = io.Copy(data, r)
+	data.Close()
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ch, wg, err := conn.readResponse()
+
+	go func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	return ch, err
+}
+
+/*
+Scan data held in memory, streaming it to clamd as ScanStream does. Data of up
+to SMALL_SCAN_SIZE bytes is sent with a single write.
+*/
+func (c *Clamd) ScanBytes(data []byte) (chan *ScanResult, error) {
+	return c.ScanBytesContext(context.Background(), data)
+}
+
+/*
+ScanBytesContext is ScanBytes bounded by ctx.
+*/
+func (c *Clamd) ScanBytesContext(ctx context.Context, data []byte) (chan *ScanResult, error) {
+	if len(data) > SMALL_SCAN_SIZE {
+		return c.ScanStreamContext(ctx, bytes.NewReader(data))
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkStreamSize(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	ch, _, err := c.instream(ctx, func(conn *CLAMDConn) (int64, error) {
+		return conn.sendBytes(ctx, data)
+	})
+	return ch, err
+}
+
+/*
+ScanFileAll is ScanFile returning every result once the scan has finished.
+If clamd reported an error for a path, the results are returned together with
+a *ClamdError for the first one. If the connection fails part way, the results
+received so far are returned along with the error.
+*/
+func (c *Clamd) ScanFileAll(path string) ([]*ScanResult, error) {
+	return collectResults(c.ScanFile(path))
+}
+
+/*
+MultiScanFileAll is MultiScanFile returning every result once the scan has
+finished.
+*/
+func (c *Clamd) MultiScanFileAll(path string) ([]*ScanResult, error) {
+	return collectResults(c.MultiScanFile(path))
+}
+
+/*
+ContScanFileAll is ContScanFile returning every result once the scan has
+finished.
+*/
+func (c *Clamd) ContScanFileAll(path string) ([]*ScanResult, error) {
+	return collectResults(c.ContScanFile(path))
+}
+
+/*
+AllMatchScanFileAll is AllMatchScanFile returning every result once the scan
+has finished. The FOUND lines for a file are merged into a single result with
+every match in Signatures; Signature and Raw are those of the first match.
+*/
+func (c *Clamd) AllMatchScanFileAll(path string) ([]*ScanResult, error) {
+	results, err := collectResults(c.AllMatchScanFile(path))
+	return mergeMatches(results), err
+}
+
+func mergeMatches(results []*ScanResult) []*ScanResult {
+	merged := make([]*ScanResult, 0, len(results))
+	found := map[string]*ScanResult{}
+
+	for _, res := range results {
+		if res.Status != RES_FOUND {
+			merged = append(merged, res)
+			continue
+		}
+
+		if first, ok := found[res.Path]; ok {
+			first.Signatures = append(first.Signatures, res.Signature)
+			continue
+		}
+
+		found[res.Path] = res
+		merged = append(merged, res)
+	}
+
+	return merged
+}
+
+/*
+ScanStreamAll is ScanStream returning every result once the scan has finished.
+*/
+func (c *Clamd) ScanStreamAll(r io.Reader) ([]*ScanResult, error) {
+	return collectResults(c.ScanStreamContext(context.Background(), r))
+}
+
+/*
+ScanStreamClean is ScanStream answering whether the data is clean, and the
+signature found if not. An ERROR from clamd is returned as a *ClamdError.
+*/
+func (c *Clamd) ScanStreamClean(r io.Reader) (bool, string, error) {
+	results, err := c.ScanStreamAll(r)
+	if err != nil {
+		return false, "", err
+	}
+
+	if len(results) == 0 {
+		return false, "", ErrNoResponse
+	}
+
+	for _, res := range results {
+		switch {
+		case res.Status == RES_FOUND:
+			return false, res.Signature, nil
+		case res.Status == RES_SKIPPED:
+			return false, "", errors.New(fmt.Sprintf("clamd: scan skipped, %s exceeded", res.Reason))
+		case !res.IsClean():
+			return false, "", errors.New(fmt.Sprintf("Invalid response, got %s.", res.Raw))
+		}
+	}
+
+	return true, "", nil
+}
+
+/*
+Scan r and return its verdict as soon as it arrives, closing the connection
+without waiting for anything else clamd may send. An ERROR from clamd is
+returned along with its result as a *ClamdError.
+*/
+func (c *Clamd) ScanStreamFirst(r io.Reader) (*ScanResult, error) {
+	return c.ScanStreamFirstContext(context.Background(), r)
+}
+
+/*
+ScanStreamFirstContext is ScanStreamFirst bounded by ctx.
+*/
+func (c *Clamd) ScanStreamFirstContext(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch, err := c.ScanStreamContext(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res, err := firstResult(ch, cancel, func(*ScanResult) bool { return true })
+	if err != nil {
+		return res, err
+	}
+
+	if res == nil {
+		return nil, ErrNoResponse
+	}
+
+	if res.Status == RES_ERROR {
+		return res, newClamdError(res)
+	}
+
+	return res, nil
+}
+
+/*
+Scan path with mode and return the first file found infected, stopping the scan
+there. Returns nil if nothing was found, along with a *ClamdError for
+the first file clamd failed to scan, if any.
+*/
+func (c *Clamd) ScanPathFirst(path string, mode ScanMode) (*ScanResult, error) {
+	return c.ScanPathFirstContext(context.Background(), path, mode)
+}
+
+/*
+ScanPathFirstContext is ScanPathFirst bounded by ctx.
+*/
+func (c *Clamd) ScanPathFirstContext(ctx context.Context, path string, mode ScanMode) (*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch, err := c.scanCommand(ctx, mode.command(), path, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return firstResult(ch, cancel, func(res *ScanResult) bool {
+		return res.Status == RES_FOUND
+	})
+}
+
+/*
+Return the first result from ch that match accepts, or the first failure to
+talk to clamd. Then cancel, which closes the connection, and drain ch so that
+no goroutine is left blocked sending to it.
+*/
+func firstResult(ch chan *ScanResult, cancel context.CancelFunc, match func(*ScanResult) bool) (*ScanResult, error) {
+	defer func() {
+		cancel()
+		DrainResults(ch)
+	}()
+
+	var clamdErr error
+
+	for s := range ch {
+		if s.Err != nil {
+			return s, s.Err
+		}
+
+		if match(s) {
+			return s, nil
+		}
+
+		if s.Status == RES_ERROR && clamdErr == nil {
+			clamdErr = newClamdError(s)
+		}
+	}
+
+	return nil, clamdErr
+}
+
+/*
+Scan the file name in fsys by streaming its contents, for files clamd can't
+reach by path, such as those in an embed.FS or an in-memory filesystem.
+*/
+func (c *Clamd) ScanFS(fsys fs.FS, name string) ([]*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return c.ScanStreamAll(f)
+}
+
+/*
+Scan an uploaded file by streaming its contents, returning clamd's verdict.
+An ERROR from clamd is returned as a *ClamdError along with the result.
+*/
+func (c *Clamd) ScanMultipart(fh *multipart.FileHeader) (*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.streamMaxLength > 0 && fh.Size > c.streamMaxLength {
+		return nil, ErrStreamSizeExceeded
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	results, err := c.ScanStreamAll(f)
+	if len(results) == 0 {
+		if err == nil {
+			err = ErrNoResponse
+		}
+
+		return nil, err
+	}
+
+	return results[0], err
+}
+
+/*
+ContScanFileSummary is ContScanFileAll that also returns the totals for the
+scan.
+*/
+func (c *Clamd) ContScanFileSummary(path string) ([]*ScanResult, *ScanSummary, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return c.scanSummary(context.Background(), CMD_CONTSCAN, path)
+}
+
+/*
+MultiScanFileSummary is MultiScanFileAll that also returns the totals for the
+scan.
+*/
+func (c *Clamd) MultiScanFileSummary(path string) ([]*ScanResult, *ScanSummary, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return c.scanSummary(context.Background(), CMD_MULTISCAN, path)
+}
+
+func (c *Clamd) scanSummary(ctx context.Context, name string, path string) ([]*ScanResult, *ScanSummary, error) {
+	var lines []string
+	var skipped int
+
+	results, err := collectResults(c.scanCommand(ctx, name, path, &scanHooks{
+		summary: func(line string) {
+			lines = append(lines, line)
+		},
+		skipped: func(*ScanResult) {
+			skipped++
+		},
+	}))
+
+	if results == nil && err != nil {
+		return nil, nil, err
+	}
+
+	return results, parseSummary(lines, results, skipped), err
+}
+
+/*
+Parse the summary lines of a scan, e.g. "Infected files: 2" and
+"Time: 1.234 sec (0 m 1 s)", falling back to counting results and the number
+of clean results skipped.
+*/
+func parseSummary(lines []string, results []*ScanResult, skipped int) *ScanSummary {
+	summary := &ScanSummary{
+		ScannedFiles:  -1,
+		InfectedFiles: -1,
+		Errors:        -1,
+	}
+
+	for _, line := range lines {
+		label, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		n, _ := strconv.Atoi(fields[0])
+
+		switch label {
+		case "Scanned directories":
+			summary.ScannedDirectories = n
+		case "Scanned files":
+			summary.ScannedFiles = n
+		case "Infected files":
+			summary.InfectedFiles = n
+		case "Total errors":
+			summary.Errors = n
+		case "Time":
+			if secs, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				summary.Elapsed = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+
+	if summary.ScannedFiles < 0 {
+		summary.ScannedFiles = len(results) + skipped
+	}
+
+	if summary.InfectedFiles < 0 {
+		summary.InfectedFiles = 0
+		for _, res := range results {
+			if res.Status == RES_FOUND {
+				summary.InfectedFiles++
+			}
+		}
+	}
+
+	if summary.Errors < 0 {
+		summary.Errors = 0
+		for _, res := range results {
+			if res.Status == RES_ERROR {
+				summary.Errors++
+			}
+		}
+	}
+
+	return summary
+}
+
+/*
+Receive and discard the rest of the results on ch. A scan's reply is read by a
+goroutine that only finishes, closing the connection to clamd, once every
+result has been received or the scan's context is done; callers that stop
+reading a result channel early without cancelling must drain it.
+*/
+func DrainResults(ch <-chan *ScanResult) {
+	for range ch {
+	}
+}
+
+/*
+Send res on ch unless ctx is done first, so goroutines delivering results
+don't block forever once the caller has given up on them.
+*/
+func sendResult(ctx context.Context, ch chan<- *ScanResult, res *ScanResult) bool {
+	select {
+	case ch <- res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+Send the error result that ends a scan on ch, which must have room for one
+result. Unlike sendResult it is never dropped: once ctx is done it takes the
+place of any result still in ch's buffer, so a scan cut short always ends with
+its error instead of looking complete, and the send can't block on a caller
+that has stopped reading.
+*/
+func sendLast(ctx context.Context, ch chan *ScanResult, res *ScanResult) {
+	if sendResult(ctx, ch, res) {
+		return
+	}
+
+	select {
+	case ch <- res:
+		return
+	default:
+	}
+
+	// Only the sender gets here, so once the buffer is emptied the send
+	// completes at once.
+	select {
+	case <-ch:
+	default:
+	}
+
+	ch <- res
+}
+
+/*
+Forward s, received from in, to out. Once ctx is done the rest of in is
+drained and only the error ending it, or ctx.Err(), is delivered; false is
+returned and the caller stops forwarding.
+*/
+func forwardResult(ctx context.Context, in <-chan *ScanResult, out chan *ScanResult, s *ScanResult) bool {
+	if s.Err != nil {
+		sendLast(ctx, out, s)
+		return true
+	}
+
+	if sendResult(ctx, out, s) {
+		return true
+	}
+
+	last := errorResult(ctx.Err())
+	for r := range in {
+		if r.Err != nil {
+			last = r
+		}
+	}
+
+	sendLast(ctx, out, last)
+	return false
+}
+
+func collectResults(ch chan *ScanResult, err error) ([]*ScanResult, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*ScanResult{}
+	var clamdErr error
+
+	for s := range ch {
+		if s.Err != nil {
+			if err == nil {
+				err = s.Err
+			}
+			continue
+		}
+
+		if s.Status == RES_ERROR && clamdErr == nil {
+			clamdErr = newClamdError(s)
+		}
+
+		results = append(results, s)
+	}
+
+	if err != nil {
+		return results, err
+	}
+
+	return results, clamdErr
+}
+
+/*
+Scan the readers concurrently over at most concurrency connections and return
+one result per reader, in the same order as the input slice. A failed scan does
+not abort the batch; its slot holds a result with status ERROR describing the
+failure. Readers not yet started when ctx is done are marked the same way and
+ctx.Err() is returned.
+*/
+func (c *Clamd) ScanStreamsOrdered(ctx context.Context, readers []io.Reader, concurrency int) ([]*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]*ScanResult, len(readers))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for i, r := range readers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, r io.Reader) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			results[i] = c.scanStreamResult(ctx, r)
+		}(i, r)
+	}
+
+	wg.Wait()
+
+	for i := range results {
+		if results[i] == nil {
+			results[i] = errorResult(ctx.Err())
+		}
+	}
+
+	return results, ctx.Err()
+}
+
+/*
+Scan each of paths with SCAN, running at most concurrency scans at a time, and
+return the results keyed by path. A path that fails to scan doesn't stop the
+others; its entry ends with a result with status ERROR describing why.
+*/
+func (c *Clamd) ScanFiles(paths []string, concurrency int) (map[string][]*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make(map[string][]*ScanResult, len(paths))
+	sem := make(chan struct{}, concurrency)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, path := range paths {
+		sem <- struct{}{}
+
+		wg.Add(1)
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			var clamdErr *ClamdError
+
+			res, err := c.ScanFileAll(path)
+			if err != nil && !errors.As(err, &clamdErr) {
+				res = append(res, errorResult(err))
+			}
+
+			mu.Lock()
+			results[path] = res
+			mu.Unlock()
+		}(path)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+/*
+Walk the directory tree at root on the client and stream every regular file to
+clamd, running at most concurrency scans at a time, for daemons that can't see
+the client's filesystem; the equivalent of CONTSCAN. The verdicts are returned
+keyed by path. skip, if set, excludes a file, or a whole directory, when it
+returns true. A file that can't be read or scanned doesn't stop the walk; its
+entry is a result with status ERROR describing why.
+*/
+func (c *Clamd) ScanDirStream(root string, concurrency int, skip func(path string, d fs.DirEntry) bool) (map[string]*ScanResult, error) {
+	return c.ScanDirStreamContext(context.Background(), root, concurrency, skip)
+}
+
+/*
+ScanDirStreamContext is ScanDirStream bounded by ctx. Once ctx is done no more
+files are started and ctx.Err() is returned along with the verdicts so far.
+*/
+func (c *Clamd) ScanDirStreamContext(ctx context.Context, root string, concurrency int, skip func(path string, d fs.DirEntry) bool) (map[string]*ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := map[string]*ScanResult{}
+	sem := make(chan struct{}, concurrency)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	store := func(path string, res *ScanResult) {
+		res.Path = path
+
+		mu.Lock()
+		results[path] = res
+		mu.Unlock()
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			store(path, errorResult(err))
+			return nil
+		}
+
+		if skip != nil && skip(path, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			f, err := os.Open(path)
+			if err != nil {
+				store(path, errorResult(err))
+				return
+			}
+
+			defer f.Close()
+
+			store(path, c.scanStreamResult(ctx, f))
+		}()
+
+		return nil
+	})
+
+	wg.Wait()
+
+	return results, err
+}
+
+func (c *Clamd) scanStreamResult(ctx context.Context, r io.Reader) *ScanResult {
+	ch, err := c.ScanStreamContext(ctx, r)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	var res *ScanResult
+	for s := range ch {
+		if res == nil {
+			res = s
+		}
+	}
+
+	if res == nil {
+		return errorResult(errors.New("No response from clamd."))
+	}
+
+	return res
+}
+
+func errorResult(err error) *ScanResult {
+	return &ScanResult{
+		Raw:         err.Error(),
+		Description: err.Error(),
+		Status:      RES_ERROR,
+		Err:         err,
+	}
+}
+
+/*
+Close every Session opened from this client that is still open. The client
+itself remains usable.
+*/
+func (c *Clamd) Close() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+
+	var err error
+	for _, s := range sessions {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func NewClamd(address string) *Clamd {
+	network, address := parseAddress(address)
+	clamd := &Clamd{network: network, address: address}
+	return clamd
+}
+
+/*
+Create a client for clamd listening on address in network, as for net.Dial:
+"tcp", "tcp4", "tcp6", "unix" or "unixpacket", or "tls" for TCP with TLS.
+Unlike NewClamd the address is used as is, so e.g. IPv6 literals need no
+special handling. Any other network fails every command when it dials.
+*/
+func NewClamdNet(network, address string) *Clamd {
+	clamd := &Clamd{network: network, address: address}
+	return clamd
+}
+
+func NewClamdWithOptions(address string, opts ...Option) *Clamd {
+	clamd := NewClamd(address)
+	for _, opt := range opts {
+		opt(clamd)
+	}
+
 	return clamd
 }
@@ -0,0 +1,240 @@
+//go:build linux
+
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	name := fmt.Sprintf("@clamd-test-%d", os.Getpid())
+
+	served := serveFake(t, "unix", name, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command == CMD_INSTREAM {
+			readChunks(r)
+			io.WriteString(conn, "stream: OK\n")
+			return
+		}
+
+		io.WriteString(conn, RES_PONG+"\n")
+	})
+
+	if served != name {
+		t.Fatalf("listening on %q, want %q", served, name)
+	}
+
+	for _, address := range []string{name, "unix://" + name} {
+		c := NewClamd(address)
+
+		if err := c.Ping(); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+
+		if _, err := collectResults(c.ScanStream(strings.NewReader("data"), nil)); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+}
+
+/*
+Receive the descriptor clamd would be passed after FILDES.
+*/
+func receiveFile(conn net.Conn) (*os.File, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket")
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.New("no control message")
+	}
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errors.New("no descriptor")
+	}
+
+	return os.NewFile(uintptr(fds[0]), "fildes"), nil
+}
+
+func TestScanFILDES(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "clamd.sock")
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		// The command is read a byte at a time: reading past it would drop
+		// the descriptor that follows.
+		b := make([]byte, 1)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				return
+			}
+
+			if b[0] == '\n' || b[0] == 0 {
+				break
+			}
+		}
+
+		f, err := receiveFile(conn)
+		if err != nil {
+			io.WriteString(conn, err.Error()+" ERROR\n")
+			return
+		}
+
+		defer f.Close()
+
+		data, _ := io.ReadAll(f)
+		if bytes.Contains(data, EICAR) {
+			io.WriteString(conn, "fd[10]: "+EICAR_SIGNATURE+" FOUND\n")
+		} else {
+			io.WriteString(conn, "fd[10]: OK\n")
+		}
+	}()
+
+	name := filepath.Join(t.TempDir(), "eicar")
+	if err := os.WriteFile(name, EICAR, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	results, err := collectResults(NewClamd(address).ScanFILDES(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Signature != EICAR_SIGNATURE {
+		t.Fatalf("got %v", results)
+	}
+}
+
+func TestSendFileWriteDeadline(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "local")
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+
+	nc, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	// A deadline already passed must fail the send rather than be ignored.
+	conn := &CLAMDConn{Conn: nc, writeTimeout: time.Minute, deadline: time.Now().Add(-time.Second)}
+
+	err = conn.sendFile(peer)
+
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestUnixPacket(t *testing.T) {
+	address := serveFake(t, "unixpacket", filepath.Join(t.TempDir(), "clamd.sock"), func(command string, r *bufio.Reader, conn net.Conn) {
+		if command != CMD_FILDES {
+			io.WriteString(conn, RES_PONG+"\n")
+			return
+		}
+
+		// Each packet is read whole, so the descriptor is still queued.
+		f, err := receiveFile(conn)
+		if err != nil {
+			io.WriteString(conn, err.Error()+" ERROR\n")
+			return
+		}
+
+		f.Close()
+		io.WriteString(conn, "fd[10]: OK\n")
+	})
+
+	c := NewClamdNet("unixpacket", address)
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	results, err := collectResults(c.ScanFILDES(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Status != RES_OK {
+		t.Fatalf("got %v", results)
+	}
+}
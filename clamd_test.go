@@ -0,0 +1,976 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Start a fake clamd on a Unix socket, calling handle with the first command of
+every connection, without its prefix and terminator. The connection is closed
+once handle returns.
+*/
+func fakeClamd(t testing.TB, handle func(command string, r *bufio.Reader, conn net.Conn)) string {
+	t.Helper()
+
+	return serveFake(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"), handle)
+}
+
+/*
+Start a fake clamd like fakeClamd listening on address, returning the address
+it listens on.
+*/
+func serveFake(t testing.TB, network, address string, handle func(command string, r *bufio.Reader, conn net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+
+				command, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				command = strings.TrimPrefix(strings.TrimRight(command, "\r\n"), "n")
+				handle(command, r, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+/*
+Start a fake clamd serving IDSESSION, answering every command within a session
+with reply and counting the sessions opened in sessions, if set.
+*/
+func fakeSessions(t testing.TB, sessions *int32, reply func(command string) string) string {
+	return fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command != CMD_IDSESSION {
+			return
+		}
+
+		if sessions != nil {
+			atomic.AddInt32(sessions, 1)
+		}
+
+		for id := 1; ; id++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			command := strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "n")
+			if command == CMD_END {
+				return
+			}
+
+			if command == CMD_INSTREAM {
+				readChunks(r)
+			}
+
+			fmt.Fprintf(conn, "%d: %s\n", id, reply(command))
+		}
+	})
+}
+
+/*
+Read INSTREAM chunks up to the terminating zero-length chunk.
+*/
+func readChunks(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return data, err
+		}
+
+		if size == 0 {
+			return data, nil
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return data, err
+		}
+
+		data = append(data, chunk...)
+	}
+}
+
+/*
+Wait for the number of goroutines to drop back to n, failing if it doesn't.
+*/
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want %d", runtime.NumGoroutine(), n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeadlineEndsResultsWithError(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/a: OK\n")
+
+		// Stall until the client gives up, before /b is reported.
+		io.Copy(io.Discard, r)
+	})
+
+	c := NewClamd(address)
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		results, err := c.ScanPathContext(ctx, "/", SCAN_CONTINUE)
+		cancel()
+
+		if err != context.DeadlineExceeded {
+			t.Fatalf("run %d: got %v, %v; want %v", i, results, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestAbandonedScanLeaksNoGoroutines(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		for i := 0; i < 100; i++ {
+			io.WriteString(conn, "/a: OK\n")
+		}
+
+		io.Copy(io.Discard, r)
+	})
+
+	c := NewClamd(address)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ch, err := c.ContScanFileContext(ctx, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		<-ch
+		cancel()
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestScanStreamTimeout(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		readChunks(r)
+		io.Copy(io.Discard, r)
+	})
+
+	c := NewClamd(address)
+	before := runtime.NumGoroutine()
+
+	results, err := collectResults(c.ScanStreamTimeout(strings.NewReader("data"), 50*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, %v; want %v", results, err, context.DeadlineExceeded)
+	}
+
+	// Not reading the results at all mustn't leave the scan running.
+	if _, err := c.ScanStreamTimeout(strings.NewReader("data"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestSupportsCachesUnknownCommand(t *testing.T) {
+	var asked int32
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command == CMD_VERSIONCOMMANDS {
+			atomic.AddInt32(&asked, 1)
+		}
+
+		io.WriteString(conn, "UNKNOWN COMMAND\n")
+	})
+
+	c := NewClamd(address)
+
+	for i := 0; i < 3; i++ {
+		if c.supports(context.Background(), CMD_FILDES) {
+			t.Fatal("FILDES supported by a daemon without VERSIONCOMMANDS")
+		}
+	}
+
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Fatalf("VERSIONCOMMANDS sent %d times, want 1", n)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{"tcp://127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"tcp://clamd", "tcp", "clamd:3310"},
+		{"tls://clamd.example.com:3311", "tls", "clamd.example.com:3311"},
+		{"unix:///var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"/var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"clamd:3310", "tcp", "clamd:3310"},
+		{"clamd.ctl", "unix", "clamd.ctl"},
+		{"[::1]:3310", "tcp", "[::1]:3310"},
+		{"tcp://[::1]:3310", "tcp", "[::1]:3310"},
+		{"tcp://[::1]", "tcp", "[::1]:3310"},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"localhost:3310", "tcp", "localhost:3310"},
+	}
+
+	for _, tt := range tests {
+		network, addr := parseAddress(tt.address)
+		if network != tt.network || addr != tt.addr {
+			t.Errorf("parseAddress(%q) = %q, %q; want %q, %q", tt.address, network, addr, tt.network, tt.addr)
+		}
+	}
+}
+
+func TestDialByScheme(t *testing.T) {
+	ping := func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, RES_PONG+"\n")
+	}
+
+	for _, address := range []string{
+		"tcp://" + serveFake(t, "tcp", "127.0.0.1:0", ping),
+		serveFake(t, "tcp", "127.0.0.1:0", ping),
+		"unix://" + fakeClamd(t, ping),
+		fakeClamd(t, ping),
+	} {
+		if err := NewClamd(address).Ping(); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+}
+
+func TestDialTCPAddresses(t *testing.T) {
+	ping := func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, RES_PONG+"\n")
+	}
+
+	for _, host := range []string{"[::1]", "127.0.0.1", "localhost"} {
+		// Not every host has IPv6 loopback.
+		l, err := net.Listen("tcp", host+":0")
+		if err != nil {
+			t.Logf("%s: skipped, %v", host, err)
+			continue
+		}
+
+		l.Close()
+
+		_, port, _ := net.SplitHostPort(serveFake(t, "tcp", host+":0", ping))
+
+		address := host + ":" + port
+		if err := NewClamd(address).Ping(); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+}
+
+func TestNewClamdNet(t *testing.T) {
+	ping := func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, RES_PONG+"\n")
+	}
+
+	for _, tt := range []struct {
+		network string
+		address string
+	}{
+		{"tcp", serveFake(t, "tcp", "127.0.0.1:0", ping)},
+		{"tcp4", serveFake(t, "tcp", "127.0.0.1:0", ping)},
+		{"unix", fakeClamd(t, ping)},
+	} {
+		if err := NewClamdNet(tt.network, tt.address).Ping(); err != nil {
+			t.Errorf("%s %s: %v", tt.network, tt.address, err)
+		}
+	}
+
+	// A network clamd can't be reached over is reported, not dialed as unix.
+	address := fakeClamd(t, ping)
+
+	for _, network := range []string{"udp", "unxi", ""} {
+		dialed := false
+		c := NewClamdNet(network, address)
+		c.dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = true
+			return nil, errors.New("dialed")
+		}
+
+		err := c.Ping()
+		if err == nil || !strings.Contains(err.Error(), "unsupported network") || dialed {
+			t.Errorf("%q: got %v, dialed %v", network, err, dialed)
+		}
+	}
+}
+
+func TestContScanMixedResults(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: OK\n/srv/b: Win.Test.EICAR_HDB-1 FOUND\n/srv/cache: Excluded\n/srv/c: OK\n")
+	})
+
+	results, err := NewClamd(address).ContScanFileAll("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path   string
+		status Status
+	}{
+		{"/srv/a", RES_OK},
+		{"/srv/b", RES_FOUND},
+		{"/srv/cache", RES_EXCLUDED},
+		{"/srv/c", RES_OK},
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+
+	for i, w := range want {
+		if results[i].Path != w.path || results[i].Status != w.status {
+			t.Errorf("result %d: got %s %s, want %s %s", i, results[i].Path, results[i].Status, w.path, w.status)
+		}
+	}
+
+	if !results[2].IsClean() {
+		t.Error("excluded path reported as not clean")
+	}
+}
+
+func TestStatsFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    Stats
+	}{
+		{"testdata/stats-1.0.txt", Stats{
+			ThreadsLive:        2,
+			ThreadsMax:         10,
+			ThreadsIdleTimeout: 30,
+			QueueJobs: []QueueJob{
+				{Command: "SCAN", Elapsed: 2503017 * time.Microsecond, Path: "/srv/big.iso"},
+				{Command: "STATS", Elapsed: 136 * time.Microsecond},
+			},
+			Memory: MemStats{Pools: 1, PoolsUsed: 1280.844, PoolsTotal: 1280.889},
+		}},
+		{"testdata/stats-0.103.txt", Stats{
+			ThreadsLive:        1,
+			ThreadsIdle:        3,
+			ThreadsMax:         12,
+			ThreadsIdleTimeout: 30,
+			QueueJobs: []QueueJob{
+				{Command: "STATS", Elapsed: 394 * time.Microsecond},
+			},
+			Memory: MemStats{Heap: 9.082, Used: 6.902, Free: 2.184, Releasable: 0.129, Pools: 1, PoolsUsed: 565.979, PoolsTotal: 565.999},
+		}},
+	}
+
+	for _, tt := range tests {
+		dump, err := os.ReadFile(tt.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+			conn.Write(dump)
+		})
+
+		stats, err := NewClamd(address).Stats()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fixture, err)
+		}
+
+		if stats.State != "VALID PRIMARY" || stats.Pools != "1" || stats.QueueItems != 0 {
+			t.Errorf("%s: got state %q, pools %q, %d queued", tt.fixture, stats.State, stats.Pools, stats.QueueItems)
+		}
+
+		got := Stats{
+			ThreadsLive:        stats.ThreadsLive,
+			ThreadsIdle:        stats.ThreadsIdle,
+			ThreadsMax:         stats.ThreadsMax,
+			ThreadsIdleTimeout: stats.ThreadsIdleTimeout,
+			QueueJobs:          stats.QueueJobs,
+			Memory:             stats.Memory,
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.fixture, got, tt.want)
+		}
+	}
+}
+
+func TestReloadResponses(t *testing.T) {
+	tests := []struct {
+		reply string
+		ok    bool
+	}{
+		{"RELOADING\n", true},
+		{"reloading\n", true},
+		{"  RELOADING \r\n", true},
+		{"RELOADED\n", true},
+		{"200 OK\n", true},
+		{"UNKNOWN COMMAND\n", false},
+		{"COMMAND UNAVAILABLE\n", false},
+		{"2000 RELOADING LATER\n", false},
+	}
+
+	for _, tt := range tests {
+		reply := tt.reply
+		address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+			io.WriteString(conn, reply)
+		})
+
+		if err := NewClamd(address).Reload(); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.reply, err)
+		}
+	}
+}
+
+func TestAllMatchScanMergesMatches(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a.zip: Win.Test.EICAR_HDB-1 FOUND\n/srv/a.zip: Eicar-Test-Signature FOUND\n/srv/b: OK\n")
+	})
+
+	results, err := NewClamd(address).AllMatchScanFileAll("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	res := results[0]
+	want := []string{"Win.Test.EICAR_HDB-1", "Eicar-Test-Signature"}
+
+	if res.Path != "/srv/a.zip" || res.Signature != want[0] || !reflect.DeepEqual(res.Signatures, want) {
+		t.Errorf("got %s %q %q, want /srv/a.zip %q %q", res.Path, res.Signature, res.Signatures, want[0], want)
+	}
+
+	if results[1].Status != RES_OK {
+		t.Errorf("got %+v after the matches", results[1])
+	}
+}
+
+func TestScanFileAllReportsFailedPath(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: OK\n/srv/logs/12:30 report.txt: Access denied. ERROR\n/srv/b: OK\n")
+	})
+
+	results, err := NewClamd(address).ScanFileAll("/srv")
+
+	var clamdErr *ClamdError
+	if !errors.As(err, &clamdErr) {
+		t.Fatalf("got %v, want a *ClamdError", err)
+	}
+
+	if clamdErr.Path != "/srv/logs/12:30 report.txt" || clamdErr.Message != "Access denied." {
+		t.Errorf("got path %q, message %q", clamdErr.Path, clamdErr.Message)
+	}
+
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("%v doesn't match fs.ErrPermission", err)
+	}
+
+	if len(results) != 3 || results[1].Status != RES_ERROR {
+		t.Errorf("got %v", results)
+	}
+}
+
+func TestRetryRejectedConnections(t *testing.T) {
+	var served int32
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		atomic.AddInt32(&served, 1)
+		io.WriteString(conn, "/x: Win.Test.EICAR_HDB-1 FOUND\n")
+	})
+
+	// Refuse the first two dials, as clamd does while it reloads.
+	var dials int32
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) <= 2 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	c := NewClamdWithOptions(address, WithRetry(3, time.Millisecond), WithDialer(dialer))
+
+	results, err := c.ScanFileAll("/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Status != RES_FOUND {
+		t.Fatalf("got %v", results)
+	}
+
+	// A scan that found something is never repeated.
+	if d, s := atomic.LoadInt32(&dials), atomic.LoadInt32(&served); d != 3 || s != 1 {
+		t.Fatalf("%d dials and %d scans, want 3 and 1", d, s)
+	}
+
+	// Once the attempts are used up the dial error is returned.
+	var refused int32
+	c = NewClamdWithOptions(address, WithRetry(2, time.Millisecond), WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&refused, 1)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}))
+
+	if err := c.Ping(); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v, want %v", err, syscall.ECONNREFUSED)
+	}
+
+	if n := atomic.LoadInt32(&refused); n != 2 {
+		t.Fatalf("%d dials, want 2", n)
+	}
+}
+
+func TestReloadOnClosedConnection(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {})
+
+	done := make(chan error, 1)
+	go func() { done <- NewClamd(address).Reload() }()
+
+	select {
+	case err := <-done:
+		if err != ErrNoResponse {
+			t.Fatalf("got %v, want %v", err, ErrNoResponse)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload blocked on a closed connection")
+	}
+}
+
+func TestShutdownLeaksNoGoroutines(t *testing.T) {
+	accepted := NewClamd(fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {}))
+	refused := NewClamd(fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "COMMAND UNAVAILABLE\n")
+	}))
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		if err := accepted.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := refused.Shutdown(); err == nil {
+			t.Fatal("refused SHUTDOWN reported as accepted")
+		}
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestConcurrentScans(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		name, arg, _ := strings.Cut(command, " ")
+
+		switch name {
+		case CMD_VERSIONCOMMANDS:
+			io.WriteString(conn, "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024| COMMANDS: SCAN CONTSCAN INSTREAM VERSION VERSIONCOMMANDS PING\n")
+		case CMD_VERSION:
+			io.WriteString(conn, "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024\n")
+		case CMD_INSTREAM:
+			readChunks(r)
+			io.WriteString(conn, "stream: OK\n")
+		default:
+			fmt.Fprintf(conn, "%s: OK\n", arg)
+		}
+	})
+
+	var completed int32
+	var raw bytes.Buffer
+
+	c := NewClamdWithOptions(address,
+		WithOnScanComplete(func(ScanEvent) { atomic.AddInt32(&completed, 1) }),
+		WithRawResponse(&raw),
+	)
+
+	pool := NewClamd(fakeSessions(t, nil, func(command string) string {
+		return "/x: OK"
+	})).NewSessionPool(4)
+	defer pool.Close()
+
+	const workers = 50
+
+	errs := make(chan error, workers*5)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("/srv/%d", i)
+
+			if _, err := c.ScanFileResult(path); err != nil {
+				errs <- err
+			}
+
+			if _, err := collectResults(c.Scan(path)); err != nil {
+				errs <- err
+			}
+
+			if _, err := c.ScanStreamAll(strings.NewReader(path)); err != nil {
+				errs <- err
+			}
+
+			if _, err := c.Version(); err != nil {
+				errs <- err
+			}
+
+			if _, err := pool.ScanFile(path); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Scan reports as the SCAN it ends up sending.
+	if n := atomic.LoadInt32(&completed); n != workers*3 {
+		t.Errorf("%d scans reported, want %d", n, workers*3)
+	}
+
+	if raw.Len() == 0 {
+		t.Error("no replies copied to the raw response writer")
+	}
+}
+
+/*
+ScanBytes sends small payloads with a single write; ScanStream writes the
+command, the chunk and the terminator separately.
+*/
+func BenchmarkScanBytes(b *testing.B) {
+	c := NewClamd(discardingClamd(b))
+	data := make([]byte, 1024)
+
+	b.Run("coalesced", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := collectResults(c.ScanBytes(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("per-write", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := collectResults(c.ScanStream(bytes.NewReader(data), nil)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+/*
+A reader counting the Read calls made on it.
+*/
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+/*
+Streaming a file reads it a chunk at a time; with WithReadAhead the file is
+read in fewer, larger reads.
+*/
+func BenchmarkReadAhead(b *testing.B) {
+	const size = 8 << 20
+
+	name := filepath.Join(b.TempDir(), "data")
+	if err := os.WriteFile(name, make([]byte, size), 0o600); err != nil {
+		b.Fatal(err)
+	}
+
+	address := discardingClamd(b)
+
+	for _, bench := range []struct {
+		name string
+		c    *Clamd
+	}{
+		{"unbuffered", NewClamd(address)},
+		{"read-ahead", NewClamdWithOptions(address, WithReadAhead(1<<20))},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(size)
+
+			reads := 0
+
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				r := &countingReader{r: f}
+
+				_, err = collectResults(bench.c.ScanStream(r, nil))
+				f.Close()
+
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				reads += r.reads
+			}
+
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestSupportsRetriesUnreachableDaemon(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "clamd.sock")
+	c := NewClamd(address)
+
+	// clamd isn't listening yet, e.g. while it restarts.
+	if c.supports(context.Background(), CMD_FILDES) {
+		t.Fatal("FILDES supported by a daemon that can't be reached")
+	}
+
+	serveFake(t, "unix", address, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024| COMMANDS: SCAN INSTREAM FILDES VERSIONCOMMANDS\n")
+	})
+
+	if !c.supports(context.Background(), CMD_FILDES) {
+		t.Fatal("FILDES not supported once the daemon is back")
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	calls := map[string]func(c *Clamd) error{
+		"Ping": func(c *Clamd) error {
+			return c.Ping()
+		},
+		"Version": func(c *Clamd) error {
+			_, err := c.Version()
+			return err
+		},
+		"Reload": func(c *Clamd) error {
+			return c.Reload()
+		},
+		"ScanFile": func(c *Clamd) error {
+			_, err := c.ScanFile("/x")
+			return err
+		},
+		"ScanStream": func(c *Clamd) error {
+			_, err := c.ScanStream(strings.NewReader("data"), nil)
+			return err
+		},
+		"NewSession": func(c *Clamd) error {
+			_, err := c.NewSession()
+			return err
+		},
+		"Stats": func(c *Clamd) error {
+			_, err := c.Stats()
+			return err
+		},
+		"NewScanJob": func(c *Clamd) error {
+			_, err := c.NewScanJob(context.Background(), "/").Wait()
+			return err
+		},
+	}
+
+	for _, c := range []*Clamd{nil, {}} {
+		for name, call := range calls {
+			if err := call(c); err != ErrNilClient {
+				t.Errorf("%s on %#v: got %v, want %v", name, c, err, ErrNilClient)
+			}
+		}
+	}
+}
+
+func TestScanPathFirstClosesConnection(t *testing.T) {
+	var open int32
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		atomic.AddInt32(&open, 1)
+		defer atomic.AddInt32(&open, -1)
+
+		io.WriteString(conn, "/srv/a: OK\n/srv/b: Win.Test.EICAR_HDB-1 FOUND\n")
+
+		// A large tree: keep reporting files until the client hangs up.
+		for {
+			if _, err := io.WriteString(conn, "/srv/c: OK\n"); err != nil {
+				return
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	c := NewClamd(address)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		res, err := c.ScanPathFirst("/srv", SCAN_CONTINUE)
+		if err != nil || res == nil || res.Path != "/srv/b" {
+			t.Fatalf("got %+v, %v", res, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&open) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left open", atomic.LoadInt32(&open))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	waitGoroutines(t, before)
+}
+
+/*
+Start a fake clamd answering STREAM on a data port of its own. With early set,
+the verdict is written together with the PORT line.
+*/
+func fakeLegacyStream(t *testing.T, early bool) string {
+	return fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command != CMD_STREAM {
+			return
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+
+		defer l.Close()
+
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		if early {
+			io.WriteString(conn, "PORT "+port+"\nstream: OK\n")
+		} else {
+			io.WriteString(conn, "PORT "+port+"\n")
+		}
+
+		dc, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		data, _ := io.ReadAll(dc)
+		dc.Close()
+
+		if early {
+			return
+		}
+
+		if bytes.Contains(data, EICAR) {
+			io.WriteString(conn, "stream: "+EICAR_SIGNATURE+" FOUND\n")
+		} else {
+			io.WriteString(conn, "stream: OK\n")
+		}
+	})
+}
+
+func TestScanStreamLegacy(t *testing.T) {
+	c := NewClamd(fakeLegacyStream(t, false))
+
+	results, err := collectResults(c.ScanStreamLegacy(bytes.NewReader(EICAR)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Signature != EICAR_SIGNATURE {
+		t.Fatalf("got %v", results)
+	}
+
+	// Whatever arrived with the PORT line is part of the reply.
+	c = NewClamd(fakeLegacyStream(t, true))
+
+	results, err = collectResults(c.ScanStreamLegacy(strings.NewReader("clean")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Status != RES_OK {
+		t.Fatalf("got %v", results)
+	}
+}
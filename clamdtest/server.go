@@ -0,0 +1,329 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Package clamdtest provides a fake clamd daemon for testing code that uses the
+clamd package, in the spirit of net/http/httptest.
+
+	srv := clamdtest.NewServer()
+	defer srv.Close()
+
+	srv.Scan = func(path string) string {
+		return clamdtest.Found("Test.Signature")
+	}
+
+	c := clamd.NewClamd(srv.Address)
+
+The server understands PING, VERSION, VERSIONCOMMANDS, RELOAD, SHUTDOWN, the
+path scan commands, INSTREAM and IDSESSION, with both the n and z command
+prefixes.
+*/
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dutchcoders/go-clamd"
+)
+
+// The version reported by a Server unless its Version is changed.
+const DEFAULT_VERSION = "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024"
+
+// OK is the reply for a clean file or stream.
+const OK = string(clamd.RES_OK)
+
+// EXCLUDED is the reply for a path clamd was configured to skip.
+const EXCLUDED = string(clamd.RES_EXCLUDED)
+
+// The reply with which clamd gives up on a stream over StreamMaxLength.
+const sizeLimitReply = "INSTREAM size limit exceeded. ERROR"
+
+var errSizeLimit = errors.New("size limit exceeded")
+
+/*
+The reply for a file or stream matching signature.
+*/
+func Found(signature string) string {
+	return signature + " " + clamd.RES_FOUND.String()
+}
+
+/*
+The reply for a file or stream clamd failed to scan with message.
+*/
+func Error(message string) string {
+	return message + " " + clamd.RES_ERROR.String()
+}
+
+/*
+A Server is a fake clamd listening on a Unix socket in a temporary directory.
+Its fields may be changed while it runs, but not concurrently with commands
+being served.
+*/
+type Server struct {
+	// Address is the socket path to pass to clamd.NewClamd.
+	Address string
+
+	// Version is the reply to VERSION.
+	Version string
+
+	// Scan returns the reply, e.g. OK or Found("Sig"), for a path sent with
+	// one of the path scan commands. It defaults to OK for every path.
+	Scan func(path string) string
+
+	// Stream returns the reply for data sent with INSTREAM. It defaults to
+	// reporting clamd.EICAR_SIGNATURE for data containing clamd.EICAR and OK
+	// otherwise.
+	Stream func(data []byte) string
+
+	// StreamMaxLength, if set, is the most INSTREAM data accepted. As with
+	// clamd, a longer stream is answered with the size limit reply as soon
+	// as the limit is passed, and the connection closed.
+	StreamMaxLength int64
+
+	mu       sync.Mutex
+	commands []string
+
+	dir      string
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+/*
+Start a Server. It must be stopped with Close.
+*/
+func NewServer() *Server {
+	dir, err := os.MkdirTemp("", "clamdtest")
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to create socket directory: %v", err))
+	}
+
+	address := filepath.Join(dir, "clamd.sock")
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(fmt.Sprintf("clamdtest: failed to listen on %s: %v", address, err))
+	}
+
+	s := &Server{
+		Address:  address,
+		Version:  DEFAULT_VERSION,
+		Scan:     func(string) string { return OK },
+		Stream:   defaultStream,
+		dir:      dir,
+		listener: l,
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+func defaultStream(data []byte) string {
+	if bytes.Contains(data, clamd.EICAR) {
+		return Found(clamd.EICAR_SIGNATURE)
+	}
+
+	return OK
+}
+
+/*
+The commands received so far, without their prefix and terminator, in the
+order they arrived.
+*/
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+/*
+Stop the server and remove its socket. Connections still open are closed by
+their clients.
+*/
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	session := false
+	id := 0
+
+	for {
+		command, delim, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+
+		switch command {
+		case "IDSESSION":
+			session = true
+			continue
+		case "END":
+			return
+		case "SHUTDOWN":
+			return
+		}
+
+		replies, ok := s.reply(command, r)
+		if !ok {
+			return
+		}
+
+		id++
+
+		for _, reply := range replies {
+			if session {
+				reply = fmt.Sprintf("%d: %s", id, reply)
+			}
+
+			if _, err := io.WriteString(conn, reply+string(delim)); err != nil {
+				return
+			}
+		}
+
+		if !session || replies[0] == sizeLimitReply {
+			return
+		}
+	}
+}
+
+/*
+Read a command, returning it and the terminator its prefix asks replies to use.
+*/
+func readCommand(r *bufio.Reader) (string, byte, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+
+	delim := byte('\n')
+	if prefix == 'z' {
+		delim = 0
+	} else if prefix != 'n' {
+		r.UnreadByte()
+	}
+
+	line, err := r.ReadString(delim)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return strings.TrimRight(line, "\r\n\x00"), delim, nil
+}
+
+func (s *Server) reply(command string, r *bufio.Reader) ([]string, bool) {
+	name, arg, _ := strings.Cut(command, " ")
+
+	switch name {
+	case "PING":
+		return []string{clamd.RES_PONG}, true
+	case "VERSION":
+		return []string{s.Version}, true
+	case "VERSIONCOMMANDS":
+		return []string{s.Version + "| COMMANDS: SCAN RAWSCAN CONTSCAN MULTISCAN ALLMATCHSCAN INSTREAM VERSION VERSIONCOMMANDS PING RELOAD SHUTDOWN IDSESSION END"}, true
+	case "RELOAD":
+		return []string{clamd.RES_RELOADING}, true
+	case "SCAN", "RAWSCAN", "CONTSCAN", "MULTISCAN", "ALLMATCHSCAN":
+		return []string{fmt.Sprintf("%s: %s", arg, s.Scan(arg))}, true
+	case "INSTREAM":
+		data, err := readStream(r, s.StreamMaxLength)
+		if err == errSizeLimit {
+			return []string{sizeLimitReply}, true
+		}
+
+		if err != nil {
+			return nil, false
+		}
+
+		return []string{"stream: " + s.Stream(data)}, true
+	}
+
+	return []string{"UNKNOWN COMMAND"}, true
+}
+
+/*
+Read INSTREAM chunks up to the terminating zero-length chunk, or until more
+than max bytes were announced if max is set.
+*/
+func readStream(r *bufio.Reader, max int64) ([]byte, error) {
+	var data []byte
+
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return data, nil
+		}
+
+		if max > 0 && int64(len(data))+int64(size) > max {
+			return nil, errSizeLimit
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+
+		data = append(data, chunk...)
+	}
+}
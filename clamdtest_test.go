@@ -0,0 +1,629 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/dutchcoders/go-clamd"
+	"github.com/dutchcoders/go-clamd/clamdtest"
+)
+
+func newServer(t *testing.T) (*clamdtest.Server, *clamd.Clamd) {
+	srv := clamdtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	return srv, clamd.NewClamd(srv.Address)
+}
+
+/*
+Drain a scan, returning its verdicts and the first error it failed with.
+*/
+func collect(ch chan *clamd.ScanResult, err error) ([]*clamd.ScanResult, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*clamd.ScanResult
+	for res := range ch {
+		if res.Err != nil {
+			if err == nil {
+				err = res.Err
+			}
+			continue
+		}
+
+		results = append(results, res)
+	}
+
+	return results, err
+}
+
+func TestPingAndVersion(t *testing.T) {
+	srv, c := newServer(t)
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := c.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Raw != clamdtest.DEFAULT_VERSION || v.DatabaseVersion != 27000 {
+		t.Fatalf("got %+v", v)
+	}
+
+	srv.Version = "ClamAV 0.103.8/26900/Tue Jun  6 07:50:25 2023"
+
+	if v, err := c.Version(); err != nil || v.DatabaseVersion != 26900 {
+		t.Fatalf("got %+v, %v", v, err)
+	}
+}
+
+func TestScanFileReplies(t *testing.T) {
+	srv, c := newServer(t)
+
+	srv.Scan = func(path string) string {
+		switch path {
+		case "/infected":
+			return clamdtest.Found("Win.Test.EICAR_HDB-1")
+		case "/excluded":
+			return clamdtest.EXCLUDED
+		case "/unreadable":
+			return clamdtest.Error("Access denied.")
+		}
+
+		return clamdtest.OK
+	}
+
+	tests := []struct {
+		path   string
+		status clamd.Status
+	}{
+		{"/clean", clamd.RES_OK},
+		{"/infected", clamd.RES_FOUND},
+		{"/excluded", clamd.RES_EXCLUDED},
+		{"/unreadable", clamd.RES_ERROR},
+	}
+
+	for _, tt := range tests {
+		res, err := c.ScanFileResult(tt.path)
+		if res == nil || res.Status != tt.status || res.Path != tt.path {
+			t.Fatalf("%s: got %+v, %v", tt.path, res, err)
+		}
+
+		var clamdErr *clamd.ClamdError
+		if (tt.status == clamd.RES_ERROR) != errors.As(err, &clamdErr) {
+			t.Fatalf("%s: got error %v", tt.path, err)
+		}
+	}
+
+	if got := srv.Commands(); len(got) != len(tests) || got[0] != "SCAN /clean" {
+		t.Fatalf("commands %q", got)
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	_, c := newServer(t)
+
+	ok, signature, err := c.ScanStreamClean(bytes.NewReader(clamd.EICAR))
+	if ok || signature != clamd.EICAR_SIGNATURE || err != nil {
+		t.Fatalf("EICAR: got %v, %q, %v", ok, signature, err)
+	}
+
+	ok, _, err = c.ScanStreamClean(strings.NewReader("clean data"))
+	if !ok || err != nil {
+		t.Fatalf("clean data: got %v, %v", ok, err)
+	}
+}
+
+func TestScanStreamSizeLimit(t *testing.T) {
+	srv, c := newServer(t)
+
+	srv.StreamMaxLength = 1024
+
+	// A stream that still fits in the socket buffers is only turned down once
+	// it has all been sent; a larger one fails a write first. Either way the
+	// reply clamd sent before closing is what is reported.
+	for _, size := range []int{2048, 16 << 20} {
+		_, err := c.ScanStreamAll(bytes.NewReader(make([]byte, size)))
+		if !errors.Is(err, clamd.ErrStreamSizeExceeded) {
+			t.Fatalf("%d bytes: got %v, want %v", size, err, clamd.ErrStreamSizeExceeded)
+		}
+	}
+
+	if _, err := c.ScanStreamAll(bytes.NewReader(make([]byte, 1024))); err != nil {
+		t.Fatalf("at the limit: got %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	srv, c := newServer(t)
+
+	srv.Scan = func(path string) string {
+		return clamdtest.Found("Test.Signature")
+	}
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ScanFile("/x")
+	if err != nil || res.Status != clamd.RES_FOUND || res.Signature != "Test.Signature" {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+
+	res, err = s.ScanStream(bytes.NewReader(clamd.EICAR))
+	if err != nil || res.Status != clamd.RES_FOUND {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	srv, c := newServer(t)
+
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.Commands(); len(got) != 1 || got[0] != "RELOAD" {
+		t.Fatalf("commands %q", got)
+	}
+}
+
+func TestNullTerminatedCommands(t *testing.T) {
+	srv, _ := newServer(t)
+
+	c := clamd.NewClamdWithOptions(srv.Address, clamd.WithNullTerminator())
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.ScanFileResult("/x"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPathMapper(t *testing.T) {
+	srv, c := newServer(t)
+
+	c.PathMapper = func(path string) string {
+		return "/mnt/shared/" + strings.TrimPrefix(strings.ReplaceAll(path, `\`, "/"), "C:/shared/")
+	}
+
+	scans := []func(path string) ([]*clamd.ScanResult, error){
+		c.ScanFileAll,
+		c.ContScanFileAll,
+		c.MultiScanFileAll,
+	}
+
+	for _, scan := range scans {
+		results, err := scan(`C:\shared\x`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 1 || results[0].Path != "/mnt/shared/x" {
+			t.Fatalf("got %v, want the mapped path", results)
+		}
+	}
+
+	want := []string{"SCAN /mnt/shared/x", "CONTSCAN /mnt/shared/x", "MULTISCAN /mnt/shared/x"}
+	if got := srv.Commands(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("commands %q, want %q", got, want)
+	}
+}
+
+func TestNilPathMapper(t *testing.T) {
+	srv, c := newServer(t)
+
+	if _, err := c.ScanFileAll(`C:\shared\x`); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.Commands(); len(got) != 1 || got[0] != `SCAN C:\shared\x` {
+		t.Fatalf("commands %q, want the path unchanged", got)
+	}
+}
+
+func TestFirstResultLeaksNoGoroutines(t *testing.T) {
+	srv, c := newServer(t)
+
+	srv.Scan = func(path string) string {
+		return clamdtest.Found("Win.Test.EICAR_HDB-1")
+	}
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		if res, err := c.ScanPathFirst("/srv", clamd.SCAN_CONTINUE); err != nil || res == nil || res.Status != clamd.RES_FOUND {
+			t.Fatalf("ScanPathFirst: got %+v, %v", res, err)
+		}
+
+		if res, err := c.ScanStreamFirst(bytes.NewReader(clamd.EICAR)); err != nil || res.Signature != clamd.EICAR_SIGNATURE {
+			t.Fatalf("ScanStreamFirst: got %+v, %v", res, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want %d", runtime.NumGoroutine(), before)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScanStreamsOrdered(t *testing.T) {
+	srv, c := newServer(t)
+
+	const n = 8
+
+	// The first readers take longest, so they finish last.
+	srv.Stream = func(data []byte) string {
+		i, _ := strconv.Atoi(string(data))
+		time.Sleep(time.Duration(n-i) * 10 * time.Millisecond)
+
+		return clamdtest.Found("Sig-" + string(data))
+	}
+
+	for _, concurrency := range []int{n, 3, 0, -1} {
+		readers := make([]io.Reader, n)
+		for i := range readers {
+			readers[i] = strings.NewReader(strconv.Itoa(i))
+		}
+
+		results, err := c.ScanStreamsOrdered(context.Background(), readers, concurrency)
+		if err != nil {
+			t.Fatalf("concurrency %d: %v", concurrency, err)
+		}
+
+		for i, res := range results {
+			if want := fmt.Sprintf("Sig-%d", i); res.Signature != want {
+				t.Fatalf("concurrency %d: result %d is %q, want %q", concurrency, i, res.Signature, want)
+			}
+		}
+	}
+}
+
+func TestScanStreamsOrderedReaderFails(t *testing.T) {
+	_, c := newServer(t)
+
+	failure := errors.New("disk error")
+	readers := []io.Reader{
+		strings.NewReader("clean"),
+		iotest.ErrReader(failure),
+		bytes.NewReader(clamd.EICAR),
+	}
+
+	results, err := c.ScanStreamsOrdered(context.Background(), readers, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Status != clamd.RES_OK || results[2].Status != clamd.RES_FOUND {
+		t.Fatalf("got %v, %v around the failed reader", results[0], results[2])
+	}
+
+	if results[1].Status != clamd.RES_ERROR || !errors.Is(results[1].Err, failure) {
+		t.Fatalf("got %+v, want the reader's error", results[1])
+	}
+}
+
+/*
+Create files, given by path relative to dir with their contents, below dir.
+*/
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	srv, c := newServer(t)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"clean": "", "infected": "", "unreadable": ""})
+
+	srv.Scan = func(path string) string {
+		switch filepath.Base(path) {
+		case "infected":
+			return clamdtest.Found("Win.Test.EICAR_HDB-1")
+		case "unreadable":
+			return clamdtest.Error("Access denied.")
+		}
+
+		return clamdtest.OK
+	}
+
+	var paths []string
+	for _, name := range []string{"clean", "infected", "unreadable"} {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	results, err := c.ScanFiles(paths, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]clamd.Status{
+		paths[0]: clamd.RES_OK,
+		paths[1]: clamd.RES_FOUND,
+		paths[2]: clamd.RES_ERROR,
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("got results for %d paths, want %d", len(results), len(want))
+	}
+
+	for path, status := range want {
+		if res := results[path]; len(res) != 1 || res[0].Status != status || res[0].Path != path {
+			t.Errorf("%s: got %v, want %s", path, res, status)
+		}
+	}
+}
+
+func TestScanDirStream(t *testing.T) {
+	srv, c := newServer(t)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"clean.txt":         "clean",
+		"sub/eicar.com":     string(clamd.EICAR),
+		"sub/broken.bin":    "broken",
+		"sub/ignored.txt":   string(clamd.EICAR),
+		"skipped/eicar.com": string(clamd.EICAR),
+	})
+
+	srv.Stream = func(data []byte) string {
+		if string(data) == "broken" {
+			return clamdtest.Error("Can't allocate memory")
+		}
+
+		if bytes.Contains(data, clamd.EICAR) {
+			return clamdtest.Found(clamd.EICAR_SIGNATURE)
+		}
+
+		return clamdtest.OK
+	}
+
+	skip := func(path string, d fs.DirEntry) bool {
+		return d.Name() == "skipped" || d.Name() == "ignored.txt"
+	}
+
+	results, err := c.ScanDirStream(dir, 2, skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]clamd.Status{
+		filepath.Join(dir, "clean.txt"):      clamd.RES_OK,
+		filepath.Join(dir, "sub/eicar.com"):  clamd.RES_FOUND,
+		filepath.Join(dir, "sub/broken.bin"): clamd.RES_ERROR,
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %v", len(results), len(want), results)
+	}
+
+	for path, status := range want {
+		if res := results[path]; res == nil || res.Status != status || res.Path != path {
+			t.Errorf("%s: got %+v, want %s", path, res, status)
+		}
+	}
+}
+
+func TestScanDirStreamCancel(t *testing.T) {
+	srv, c := newServer(t)
+
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("f%02d", i)] = "data"
+	}
+	writeTree(t, dir, files)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel once the first file is being scanned.
+	srv.Stream = func(data []byte) string {
+		cancel()
+		return clamdtest.OK
+	}
+
+	results, err := c.ScanDirStreamContext(ctx, dir, 1, nil)
+	if err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	if len(results) >= len(files) {
+		t.Fatalf("all %d files scanned after cancel", len(results))
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	srv, c := newServer(t)
+
+	if err := c.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A daemon that misses EICAR fails the self test.
+	srv.Stream = func(data []byte) string { return clamdtest.OK }
+
+	if err := c.SelfTest(); err == nil {
+		t.Fatal("missed detection passed the self test")
+	}
+
+	srv.Stream = func(data []byte) string { return clamdtest.Found("Custom-Test-Signature") }
+
+	if err := c.SelfTest(); err == nil {
+		t.Fatal("unexpected signature passed the self test")
+	}
+
+	c = clamd.NewClamdWithOptions(srv.Address, clamd.WithEICARSignature("Custom-Test-Signature"))
+
+	if err := c.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanStreamGzip(t *testing.T) {
+	_, c := newServer(t)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(clamd.EICAR)
+	zw.Close()
+
+	compressed := buf.Bytes()
+
+	results, err := collect(c.ScanStreamGzip(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Status != clamd.RES_FOUND {
+		t.Fatalf("got %v", results)
+	}
+
+	if _, err := c.ScanStreamGzip(bytes.NewReader(clamd.EICAR)); !errors.Is(err, clamd.ErrNotGzip) {
+		t.Fatalf("got %v, want ErrNotGzip", err)
+	}
+
+	// A stream cut short fails while it is sent, not as a verdict.
+	results, err = collect(c.ScanStreamGzip(bytes.NewReader(compressed[:len(compressed)-10])))
+	if err == nil {
+		t.Fatalf("truncated gzip scanned as %v", results)
+	}
+}
+
+/*
+Upload files as a multipart form and parse it back the way an HTTP handler
+would, returning a header per file.
+*/
+func uploadForm(t *testing.T, files map[string][]byte) map[string]*multipart.FileHeader {
+	t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	for name, data := range files {
+		part, err := w.CreateFormFile(name, name+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		part.Write(data)
+	}
+
+	w.Close()
+
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { form.RemoveAll() })
+
+	headers := map[string]*multipart.FileHeader{}
+	for name, fhs := range form.File {
+		headers[name] = fhs[0]
+	}
+
+	return headers
+}
+
+func TestScanMultipart(t *testing.T) {
+	srv, c := newServer(t)
+
+	headers := uploadForm(t, map[string][]byte{
+		"infected": clamd.EICAR,
+		"clean":    []byte("clean"),
+	})
+
+	res, err := c.ScanMultipart(headers["infected"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != clamd.RES_FOUND || res.Description != clamd.EICAR_SIGNATURE {
+		t.Fatalf("got %+v", res)
+	}
+
+	if res, err := c.ScanMultipart(headers["clean"]); err != nil || res.Status != clamd.RES_OK {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+
+	// Parts over the limit are refused without being sent.
+	c = clamd.NewClamdWithOptions(srv.Address, clamd.WithStreamMaxLength(4))
+	before := len(srv.Commands())
+
+	if _, err := c.ScanMultipart(headers["clean"]); !errors.Is(err, clamd.ErrStreamSizeExceeded) {
+		t.Fatalf("got %v, want ErrStreamSizeExceeded", err)
+	}
+
+	if len(srv.Commands()) != before {
+		t.Fatalf("commands %q", srv.Commands())
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+A clock that only moves when told to. Every call to After is announced on
+waiting, so tests can advance time once the code under test is blocked.
+*/
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		waiting: make(chan time.Duration, 100),
+	}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	f.timers = append(f.timers, fakeTimer{at: f.now.Add(d), ch: ch})
+	f.waiting <- d
+
+	return ch
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.at.After(f.now) {
+			pending = append(pending, timer)
+			continue
+		}
+
+		timer.ch <- f.now
+	}
+
+	f.timers = pending
+}
+
+func TestRetryBackoffWithFakeClock(t *testing.T) {
+	clk := newFakeClock()
+
+	c := NewClamdWithOptions(t.TempDir()+"/missing.sock", WithRetry(3, time.Hour))
+	c.clock = clk
+
+	done := make(chan error)
+	go func() { done <- c.Ping() }()
+
+	// The backoff doubles between attempts.
+	for _, want := range []time.Duration{time.Hour, 2 * time.Hour} {
+		select {
+		case d := <-clk.waiting:
+			if d != want {
+				t.Fatalf("backoff %v, want %v", d, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no retry")
+		}
+
+		clk.Advance(want)
+	}
+
+	if err := <-done; err == nil {
+		t.Fatal("ping succeeded without a server")
+	}
+}
+
+func TestPoolIdleTimeoutWithFakeClock(t *testing.T) {
+	var sessions int32
+	address := fakeSessions(t, &sessions, func(command string) string {
+		return "/x: OK"
+	})
+
+	clk := newFakeClock()
+
+	c := NewClamdWithOptions(address, WithIdleTimeout(time.Minute))
+	c.clock = clk
+
+	p := c.NewSessionPool(1)
+	defer p.Close()
+
+	scan := func() {
+		t.Helper()
+
+		if res, err := p.ScanFile("/x"); err != nil || res.Status != RES_OK {
+			t.Fatal(res, err)
+		}
+	}
+
+	scan()
+	clk.Advance(30 * time.Second)
+	scan()
+
+	if n := atomic.LoadInt32(&sessions); n != 1 {
+		t.Fatalf("%d sessions opened within the idle timeout, want 1", n)
+	}
+
+	clk.Advance(2 * time.Minute)
+	scan()
+
+	if n := atomic.LoadInt32(&sessions); n != 2 {
+		t.Fatalf("%d sessions opened, want an idle session replaced", n)
+	}
+}
+
+func TestKeepaliveWithFakeClock(t *testing.T) {
+	var pings int32
+	address := fakeSessions(t, nil, func(command string) string {
+		if command == CMD_PING {
+			atomic.AddInt32(&pings, 1)
+			return RES_PONG
+		}
+
+		return "/x: OK"
+	})
+
+	clk := newFakeClock()
+
+	c := NewClamd(address)
+	c.clock = clk
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Keepalive(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		<-clk.waiting
+		clk.Advance(time.Minute)
+	}
+
+	// The third timer is only set once the second ping got its reply.
+	if n := atomic.LoadInt32(&pings); n < 2 {
+		t.Fatalf("%d pings sent, want at least 2", n)
+	}
+
+	s.Close()
+}
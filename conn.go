@@ -27,6 +27,10 @@ package clamd
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -38,55 +42,446 @@ import (
 )
 
 const CHUNK_SIZE = 1024
+
+// MAX_CHUNK_SIZE is the largest INSTREAM chunk sent. The length header would
+// allow up to 4 GiB, but clamd has to buffer every chunk whole.
+const MAX_CHUNK_SIZE = 1 << 24
+
+// SMALL_SCAN_SIZE is the largest payload ScanBytes sends in a single write.
+const SMALL_SCAN_SIZE = 4096
+
+// MAX_LINE_LENGTH is the longest reply line accepted from clamd unless
+// configured otherwise with WithMaxResponseLineLength.
+const MAX_LINE_LENGTH = 1 << 20
+
 const TCP_TIMEOUT = time.Second * 2
+const DEFAULT_PORT = "3310"
 
+// The path ends at the last ": " and only the final word is taken as the
+// status, so paths may contain colons and signatures spaces. Error messages
+// with a colon are put back together by parseResult.
 var resultRegex = regexp.MustCompile(
-	`^(?P<path>[^:]+): ((?P<desc>[^:]+)(\((?P<virhash>([^:]+)):(?P<virsize>\d+)\))? )?(?P<status>FOUND|ERROR|OK)$`,
+	`^(?P<path>.+): ((?P<desc>.+?)(\((?P<virhash>([^:()]+)):(?P<virsize>\d+)\))? )?(?P<status>FOUND|ERROR|OK|Excluded)$`,
 )
 
+// clamd's error messages with a colon name the call that failed, as in
+// "lstat() failed: No such file or directory.".
+var failedCallRegex = regexp.MustCompile(`: (\w+\(\) failed)$`)
+
 type CLAMDConn struct {
 	net.Conn
+
+	// network and address the connection was dialed with.
+	network string
+	address string
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	deadline     time.Time
+
+	// nullTerminated selects the z prefix, with commands and replies
+	// terminated by NUL instead of newline.
+	nullTerminated bool
+
+	// terminator ends n prefixed commands, newline unless set.
+	terminator string
+
+	logf func(format string, args ...any)
+
+	// raw is given every line received, before it is parsed.
+	raw func(line string)
+
+	maxLineLength int
+
+	// reader buffers replies; see bufReader.
+	reader *bufio.Reader
+
+	ctx  context.Context
+	stop func() bool
+}
+
+/*
+The reader replies are read through. It is shared by every read on the
+connection, so nothing one read buffered ahead is lost to the next.
+*/
+func (conn *CLAMDConn) bufReader() *bufio.Reader {
+	if conn.reader == nil {
+		conn.reader = bufio.NewReader(conn)
+	}
+
+	return conn.reader
+}
+
+/*
+Apply the deadline of ctx to the connection and close it as soon as ctx is
+done, which unblocks any pending read or write.
+*/
+func (conn *CLAMDConn) watch(ctx context.Context) {
+	conn.ctx = ctx
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.deadline = deadline
+	}
+
+	conn.stop = context.AfterFunc(ctx, func() {
+		conn.Conn.Close()
+	})
+}
+
+/*
+The deadline for an operation that may take up to d, capped by the deadline of
+the context the connection was opened with. Zero means no deadline.
+*/
+func (conn *CLAMDConn) deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return conn.deadline
+	}
+
+	t := time.Now().Add(d)
+	if !conn.deadline.IsZero() && conn.deadline.Before(t) {
+		return conn.deadline
+	}
+
+	return t
+}
+
+/*
+Every read gets a fresh read timeout, so it acts as an idle timeout: a long
+scan that keeps producing output is not cut off.
+*/
+func (conn *CLAMDConn) Read(b []byte) (int, error) {
+	conn.SetReadDeadline(conn.deadlineAfter(conn.readTimeout))
+	return conn.Conn.Read(b)
+}
+
+func (conn *CLAMDConn) Write(b []byte) (int, error) {
+	conn.SetWriteDeadline(conn.deadlineAfter(conn.writeTimeout))
+	return conn.Conn.Write(b)
+}
+
+/*
+Enable TCP keepalive probes every d. Does nothing for Unix sockets.
+*/
+func (conn *CLAMDConn) setKeepAlive(d time.Duration) {
+	nc := conn.Conn
+	if tc, ok := nc.(*tls.Conn); ok {
+		nc = tc.NetConn()
+	}
+
+	if tc, ok := nc.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(d)
+	}
+}
+
+func (conn *CLAMDConn) Close() error {
+	if conn.stop != nil {
+		conn.stop()
+	}
+
+	return conn.Conn.Close()
+}
+
+func (conn *CLAMDConn) commandBytes(command string) []byte {
+	if conn.nullTerminated {
+		return []byte(fmt.Sprintf("z%s\x00", command))
+	}
+
+	terminator := conn.terminator
+	if terminator == "" {
+		terminator = "\n"
+	}
+
+	return []byte("n" + command + terminator)
 }
 
 func (conn *CLAMDConn) sendCommand(command string) error {
-	commandBytes := []byte(fmt.Sprintf("n%s\n", command))
+	conn.log("clamd: sending %q", command)
 
-	_, err := conn.Write(commandBytes)
+	_, err := conn.Write(conn.commandBytes(command))
 	return err
 }
 
+func (conn *CLAMDConn) log(format string, args ...any) {
+	if conn.logf != nil {
+		conn.logf(format, args...)
+	}
+}
+
 func (conn *CLAMDConn) sendEOF() error {
 	_, err := conn.Write([]byte{0, 0, 0, 0})
 	return err
 }
 
+/*
+Write the 4 byte length header and data in a single write.
+*/
 func (conn *CLAMDConn) sendChunk(data []byte) error {
-	var buf [4]byte
-	lenData := len(data)
-	buf[0] = byte(lenData >> 24)
-	buf[1] = byte(lenData >> 16)
-	buf[2] = byte(lenData >> 8)
-	buf[3] = byte(lenData >> 0)
+	if len(data) > MAX_CHUNK_SIZE {
+		return ErrChunkTooLarge
+	}
 
-	a := buf
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	_, err := conn.Write(buf)
+	return err
+}
 
-	b := make([]byte, len(a))
-	for i := range a {
-		b[i] = a[i]
+/*
+Send INSTREAM followed by the contents of r in chunks of chunkSize and the
+terminating zero-length chunk, returning the number of bytes of r sent. Stops
+at the first failed write and returns the reason clamd gave, if any, or
+ctx.Err() once ctx is done. A read error other than io.EOF is returned without
+ending the stream.
+*/
+func (conn *CLAMDConn) sendStream(ctx context.Context, r io.Reader, chunkSize int) (int64, error) {
+	var sent int64
+
+	if chunkSize > MAX_CHUNK_SIZE {
+		return sent, ErrChunkTooLarge
 	}
 
-	conn.Write(b)
+	if err := conn.sendCommand(CMD_INSTREAM); err != nil {
+		return sent, err
+	}
 
-	_, err := conn.Write(data)
-	return err
+	// One buffer, with room for the chunk header, is reused for every chunk;
+	// Write is done with it before the next Read.
+	buf := make([]byte, 4+chunkSize)
+
+	for {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		// Readers may return the last bytes together with io.EOF or another
+		// error, so whatever was read is sent before err is looked at.
+		nr, err := r.Read(buf[4:])
+		if nr > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(nr))
+
+			if _, err := conn.Write(buf[:4+nr]); err != nil {
+				return sent, conn.writeError(ctx, err)
+			}
+
+			sent += int64(nr)
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		// Ending the stream here would have clamd scan, and possibly
+		// pass, a truncated copy of the data.
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	if err := conn.sendEOF(); err != nil {
+		return sent, conn.writeError(ctx, err)
+	}
+
+	return sent, nil
+}
+
+/*
+Send INSTREAM followed by r, which is already framed as INSTREAM chunks, up to
+and including its zero-length chunk. Each chunk's header is checked as it goes
+by, but the data is copied as is. Returns the number of data bytes sent, not
+counting headers, and ErrStreamNotTerminated if r ends before the zero-length
+chunk, which is never sent on r's behalf.
+*/
+func (conn *CLAMDConn) sendFramed(ctx context.Context, r io.Reader) (int64, error) {
+	var sent int64
+
+	if err := conn.sendCommand(CMD_INSTREAM); err != nil {
+		return sent, err
+	}
+
+	buf := make([]byte, 4+CHUNK_SIZE)
+
+	for {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			if err == io.EOF {
+				err = ErrStreamNotTerminated
+			}
+
+			return sent, err
+		}
+
+		size := binary.BigEndian.Uint32(buf[:4])
+		if size > MAX_CHUNK_SIZE {
+			return sent, ErrChunkTooLarge
+		}
+
+		// The header goes out with the start of the chunk's data.
+		n := 4
+
+		for remaining := int(size); ; {
+			nr := min(remaining, CHUNK_SIZE)
+			if _, err := io.ReadFull(r, buf[n:n+nr]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+
+				return sent, err
+			}
+
+			if _, err := conn.Write(buf[:n+nr]); err != nil {
+				return sent, conn.writeError(ctx, err)
+			}
+
+			sent += int64(nr)
+			remaining -= nr
+
+			if remaining == 0 {
+				break
+			}
+
+			n = 0
+		}
+
+		if size == 0 {
+			return sent, nil
+		}
+	}
+}
+
+/*
+Send INSTREAM, data as a single chunk and the terminating zero-length chunk in
+one write. Meant for payloads small enough that the separate writes of
+sendStream would dominate the cost of the scan.
+*/
+func (conn *CLAMDConn) sendBytes(ctx context.Context, data []byte) (int64, error) {
+	conn.log("clamd: sending %q with %d bytes", CMD_INSTREAM, len(data))
+
+	command := conn.commandBytes(CMD_INSTREAM)
+
+	buf := make([]byte, 0, len(command)+4+len(data)+4)
+	buf = append(buf, command...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	buf = append(buf, 0, 0, 0, 0)
+
+	if _, err := conn.Write(buf); err != nil {
+		return 0, conn.writeError(ctx, err)
+	}
+
+	return int64(len(data)), nil
+}
+
+func (conn *CLAMDConn) writeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return conn.responseError(err)
+}
+
+/*
+When clamd gives up on a stream (e.g. the size limit was hit) it writes the
+reason and closes the socket, so the failed write itself only reports a broken
+pipe. Read whatever clamd sent before closing and return that instead.
+*/
+func (conn *CLAMDConn) responseError(err error) error {
+	// The connection is given up on, so the wait for the reason may as
+	// well be short.
+	if conn.readTimeout <= 0 || conn.readTimeout > TCP_TIMEOUT {
+		conn.readTimeout = TCP_TIMEOUT
+	}
+
+	line, _ := conn.readLine(conn.bufReader())
+	if line == "" {
+		return err
+	}
+
+	// Within a session the reply is tagged with the command's id.
+	if id, reply, ok := strings.Cut(line, ": "); ok {
+		if _, err := strconv.Atoi(id); err == nil {
+			line = reply
+		}
+	}
+
+	if err := replyError(line); err != nil {
+		return err
+	}
+
+	return errors.New(line)
+}
+
+/*
+Read a single reply line, terminated by newline or NUL depending on the
+command prefix in use, without its terminator.
+*/
+func (conn *CLAMDConn) readLine(reader *bufio.Reader) (string, error) {
+	delim := byte('\n')
+	if conn.nullTerminated {
+		delim = 0
+	}
+
+	max := conn.maxLineLength
+	if max <= 0 {
+		max = MAX_LINE_LENGTH
+	}
+
+	var line []byte
+
+	for {
+		frag, err := reader.ReadSlice(delim)
+		if len(line)+len(frag) > max {
+			return "", ErrLineTooLong
+		}
+
+		line = append(line, frag...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if len(line) > 0 {
+			conn.log("clamd: received %q", line)
+		}
+
+		s := strings.TrimRight(string(line), " \t\r\n\x00")
+		if conn.raw != nil && len(line) > 0 {
+			conn.raw(s)
+		}
+
+		return s, err
+	}
 }
 
 func (c *CLAMDConn) readResponse() (chan *ScanResult, *sync.WaitGroup, error) {
 	var wg sync.WaitGroup
 
 	wg.Add(1)
-	reader := bufio.NewReader(c)
-	ch := make(chan *ScanResult)
+	reader := c.bufReader()
+
+	// Room for the result ending the reply, which is always delivered.
+	ch := make(chan *ScanResult, 1)
+
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Lines are dropped once ctx is done, but then the reply ends with
+	// ctx.Err() rather than looking complete.
+	send := func(res *ScanResult) bool {
+		if sendResult(ctx, ch, res) {
+			return true
+		}
+
+		sendLast(ctx, ch, errorResult(ctx.Err()))
+		return false
+	}
 
 	go func() {
 		defer func() {
@@ -95,23 +490,88 @@ func (c *CLAMDConn) readResponse() (chan *ScanResult, *sync.WaitGroup, error) {
 		}()
 
 		for {
-			line, err := reader.ReadString('\n')
+			line, err := c.readLine(reader)
+
+			// clamd drops the connection after these replies, possibly
+			// without terminating them.
+			if rerr := replyError(line); rerr != nil {
+				sendLast(ctx, ch, errorResult(rerr))
+				return
+			}
+
+			// The last line may be cut short by clamd closing the
+			// connection right after writing it.
 			if err == io.EOF {
+				if line != "" {
+					send(parseResult(line))
+				}
+
 				return
 			}
 
 			if err != nil {
+				sendLast(ctx, ch, errorResult(c.readError(err)))
 				return
 			}
 
-			line = strings.TrimRight(line, " \t\r\n")
-			ch <- parseResult(line)
+			if !send(parseResult(line)) {
+				return
+			}
 		}
 	}()
 
 	return ch, &wg, nil
 }
 
+/*
+Map a failed read to ctx.Err() once the connection's context is done, or to
+ErrReadTimeout when the read timeout ran out.
+*/
+func (conn *CLAMDConn) readError(err error) error {
+	if conn.ctx != nil && conn.ctx.Err() != nil {
+		return conn.ctx.Err()
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		// The socket deadline of ctx can expire just before ctx does.
+		if !conn.deadline.IsZero() && !time.Now().Before(conn.deadline) {
+			return context.DeadlineExceeded
+		}
+
+		return ErrReadTimeout
+	}
+
+	return err
+}
+
+func isCommandTimeout(line string) bool {
+	return line == "COMMAND READ TIMED OUT"
+}
+
+/*
+The error for a reply with which clamd gives up on the command and closes the
+connection, or nil. A stream over the size limit may be all sent, and the
+reply read as usual, before clamd has counted it, so both the write and the
+read side check for it.
+*/
+func replyError(line string) error {
+	if strings.HasPrefix(line, "INSTREAM size limit exceeded") {
+		return ErrStreamSizeExceeded
+	}
+
+	if isCommandTimeout(line) {
+		return ErrCommandTimeout
+	}
+
+	// Per file the reply starts with the path; on its own it's the command
+	// that was refused.
+	if strings.HasPrefix(line, "Access denied") {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
 func parseResult(line string) *ScanResult {
 	res := &ScanResult{}
 	res.Raw = line
@@ -137,42 +597,58 @@ func parseResult(line string) *ScanResult {
 				res.Size = i
 			}
 		case "status":
-			switch matches[i] {
+			switch Status(matches[i]) {
 			case RES_OK:
 			case RES_FOUND:
 			case RES_ERROR:
+			case RES_EXCLUDED:
 				break
 			default:
 				res.Description = "Invalid status field: " + matches[i]
 				res.Status = RES_PARSE_ERROR
 				return res
 			}
-			res.Status = matches[i]
+			res.Status = Status(matches[i])
 		}
 	}
 
-	return res
-}
-
-func newCLAMDTcpConn(address string) (*CLAMDConn, error) {
-	conn, err := net.DialTimeout("tcp", address, TCP_TIMEOUT)
+	if res.Status == RES_ERROR {
+		if m := failedCallRegex.FindStringSubmatchIndex(res.Path); m != nil {
+			res.Description = res.Path[m[2]:] + ": " + res.Description
+			res.Path = res.Path[:m[0]]
+		}
+	}
 
-	if err != nil {
-		if nerr, isOk := err.(net.Error); isOk && nerr.Timeout() {
-			return nil, nerr
+	if res.Status == RES_FOUND {
+		if reason, ok := limitExceeded(res.Description); ok {
+			res.Status = RES_SKIPPED
+			res.Reason = reason
+			return res
 		}
 
-		return nil, err
+		res.Signature = res.Description
+		res.Signatures = []string{res.Signature}
 	}
 
-	return &CLAMDConn{Conn: conn}, err
+	return res
 }
 
-func newCLAMDUnixConn(address string) (*CLAMDConn, error) {
-	conn, err := net.Dial("unix", address)
-	if err != nil {
-		return nil, err
+/*
+clamd reports a file that exceeds a scan limit as Heuristics.Limits.Exceeded,
+with the limit appended by newer releases, e.g.
+Heuristics.Limits.Exceeded.MaxFileSize.
+*/
+func limitExceeded(signature string) (string, bool) {
+	const prefix = "Heuristics.Limits.Exceeded"
+
+	if !strings.HasPrefix(signature, prefix) {
+		return "", false
+	}
+
+	reason := strings.TrimPrefix(strings.TrimPrefix(signature, prefix), ".")
+	if reason == "" {
+		reason = "limit"
 	}
 
-	return &CLAMDConn{Conn: conn}, err
+	return reason, true
 }
@@ -0,0 +1,489 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+)
+
+/*
+Frame chunks as INSTREAM data, ending with the zero-length chunk if terminate
+is set.
+*/
+func frame(terminate bool, chunks ...[]byte) []byte {
+	var b bytes.Buffer
+
+	for _, chunk := range chunks {
+		binary.Write(&b, binary.BigEndian, uint32(len(chunk)))
+		b.Write(chunk)
+	}
+
+	if terminate {
+		b.Write([]byte{0, 0, 0, 0})
+	}
+
+	return b.Bytes()
+}
+
+/*
+An endless stream of data.
+*/
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+
+	return len(p), nil
+}
+
+/*
+Start a fake clamd that reads the INSTREAM command and its first chunk, then
+writes reply, if any, and closes the connection.
+*/
+func closeAfterFirstChunk(t *testing.T, reply string) string {
+	return fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return
+		}
+
+		io.WriteString(conn, reply)
+	})
+}
+
+func TestScanStreamStopsOnClosedStream(t *testing.T) {
+	c := NewClamd(closeAfterFirstChunk(t, "INSTREAM size limit exceeded. ERROR\n"))
+
+	// The reader never ends, so the scan only returns if the send loop
+	// gives up on the first failed write.
+	_, err := collectResults(c.ScanStreamContext(context.Background(), endlessReader{}))
+	if !errors.Is(err, ErrStreamSizeExceeded) {
+		t.Fatalf("got %v, want %v", err, ErrStreamSizeExceeded)
+	}
+}
+
+func TestScanStreamReportsWriteError(t *testing.T) {
+	c := NewClamd(closeAfterFirstChunk(t, ""))
+
+	_, err := collectResults(c.ScanStreamContext(context.Background(), endlessReader{}))
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "write" {
+		t.Fatalf("got %v, want the write error", err)
+	}
+}
+
+func TestScanStreamOverTCP(t *testing.T) {
+	address := serveFake(t, "tcp", "127.0.0.1:0", func(command string, r *bufio.Reader, conn net.Conn) {
+		if command != CMD_INSTREAM {
+			return
+		}
+
+		data, err := readChunks(r)
+		if err == nil && bytes.Contains(data, EICAR) {
+			io.WriteString(conn, "stream: "+EICAR_SIGNATURE+" FOUND\n")
+		}
+	})
+
+	for _, address := range []string{address, "tcp://" + address} {
+		results, err := collectResults(NewClamd(address).ScanStream(bytes.NewReader(EICAR), nil))
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+
+		if len(results) != 1 || results[0].Signature != EICAR_SIGNATURE {
+			t.Fatalf("%s: got %v", address, results)
+		}
+	}
+}
+
+func TestScanStreamRaw(t *testing.T) {
+	wire := make(chan []byte, 1)
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		var b bytes.Buffer
+		data, err := readChunks(bufio.NewReader(io.TeeReader(r, &b)))
+		wire <- b.Bytes()
+
+		if err == nil {
+			conn.Write([]byte("stream: " + string(data) + " FOUND\n"))
+		}
+	})
+
+	c := NewClamd(address)
+
+	large := bytes.Repeat([]byte("x"), 3*CHUNK_SIZE+1)
+	framed := frame(true, []byte("Sig"), large)
+
+	results, err := collectResults(c.ScanStreamRaw(bytes.NewReader(append(framed, "trailing"...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(<-wire, framed) {
+		t.Fatal("framed data not sent as is")
+	}
+
+	if len(results) != 1 || results[0].Status != RES_FOUND {
+		t.Fatalf("got %v", results)
+	}
+
+	if _, err := c.ScanStreamRaw(bytes.NewReader(frame(false, []byte("data")))); err != ErrStreamNotTerminated {
+		t.Fatalf("got %v, want %v", err, ErrStreamNotTerminated)
+	}
+
+	if _, err := c.ScanStreamRaw(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err != ErrChunkTooLarge {
+		t.Fatalf("got %v, want %v", err, ErrChunkTooLarge)
+	}
+}
+
+func TestParseLimitExceeded(t *testing.T) {
+	tests := []struct {
+		line   string
+		status Status
+		reason string
+	}{
+		{"/srv/big.iso: Heuristics.Limits.Exceeded FOUND", RES_SKIPPED, "limit"},
+		{"/srv/big.iso: Heuristics.Limits.Exceeded.MaxFileSize FOUND", RES_SKIPPED, "MaxFileSize"},
+		{"/srv/big.iso: Heuristics.Limits.Exceeded.MaxScanSize FOUND", RES_SKIPPED, "MaxScanSize"},
+		{"/srv/nested.zip: Heuristics.Limits.Exceeded.MaxRecursion FOUND", RES_SKIPPED, "MaxRecursion"},
+		{"/srv/many.tar: Heuristics.Limits.Exceeded.MaxFiles FOUND", RES_SKIPPED, "MaxFiles"},
+		{"/srv/slow.pdf: Heuristics.Limits.Exceeded.MaxScanTime FOUND", RES_SKIPPED, "MaxScanTime"},
+		{"/srv/eicar.txt: Win.Test.EICAR_HDB-1 FOUND", RES_FOUND, ""},
+	}
+
+	for _, tt := range tests {
+		res := parseResult(tt.line)
+		if res.Status != tt.status || res.Reason != tt.reason {
+			t.Errorf("%q: got %s %q, want %s %q", tt.line, res.Status, res.Reason, tt.status, tt.reason)
+		}
+
+		if tt.status == RES_SKIPPED && (res.Signature != "" || res.IsClean()) {
+			t.Errorf("%q: skipped file reported as %q, clean %v", tt.line, res.Signature, res.IsClean())
+		}
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	for _, line := range []string{"Access denied", "Access denied.", "Access denied. ERROR"} {
+		if err := replyError(line); err != ErrAccessDenied {
+			t.Errorf("%q: got %v, want %v", line, err, ErrAccessDenied)
+		}
+	}
+
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command == CMD_VERSION {
+			io.WriteString(conn, "Access denied.\n")
+			return
+		}
+
+		io.WriteString(conn, "/srv/secret: Access denied. ERROR\n")
+	})
+
+	c := NewClamd(address)
+
+	if _, err := c.Version(); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("refused command: got %v, want %v", err, ErrAccessDenied)
+	}
+
+	// A file clamd can't read is the file's problem, not the client's.
+	_, err := c.ScanFileAll("/srv/secret")
+	if !errors.Is(err, fs.ErrPermission) || errors.Is(err, ErrAccessDenied) {
+		t.Errorf("unreadable file: got %v, want fs.ErrPermission", err)
+	}
+}
+
+func TestSocketPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("socket permissions don't apply to root")
+	}
+
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {})
+	if err := os.Chmod(address, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewClamd(address).Ping(); !errors.Is(err, ErrAccessDenied) || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, want %v", err, ErrAccessDenied)
+	}
+}
+
+/*
+A dialer connecting to serve over net.Pipe instead of a socket.
+*/
+func pipeDialer(serve func(conn net.Conn)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+
+		go func() {
+			defer server.Close()
+			serve(server)
+		}()
+
+		return client, nil
+	}
+}
+
+func TestCommandTerminatorOnTheWire(t *testing.T) {
+	tests := []struct {
+		opts  []Option
+		wire  string
+		reply string
+	}{
+		{nil, "nPING\n", "PONG\n"},
+		{[]Option{WithCommandTerminator("\r\n")}, "nPING\r\n", "PONG\r\n"},
+		{[]Option{WithNullTerminator()}, "zPING\x00", "PONG\x00"},
+		{[]Option{WithNullTerminator(), WithCommandTerminator("\r\n")}, "zPING\x00", "PONG\x00"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		wire := make(chan string, 1)
+		dialer := pipeDialer(func(conn net.Conn) {
+			delim := byte('\n')
+			if strings.HasPrefix(tt.wire, "z") {
+				delim = 0
+			}
+
+			line, _ := bufio.NewReader(conn).ReadString(delim)
+			wire <- line
+
+			io.WriteString(conn, tt.reply)
+		})
+
+		c := NewClamdWithOptions("/clamd.sock", append(tt.opts, WithDialer(dialer))...)
+		if err := c.Ping(); err != nil {
+			t.Errorf("%q: %v", tt.wire, err)
+		}
+
+		if got := <-wire; got != tt.wire {
+			t.Errorf("sent %q, want %q", got, tt.wire)
+		}
+	}
+}
+
+func TestFinalLineWithoutNewline(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command == CMD_VERSION {
+			io.WriteString(conn, "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024")
+			return
+		}
+
+		io.WriteString(conn, "/srv/a: OK\n/srv/b: Win.Test.EICAR_HDB-1 FOUND")
+	})
+
+	c := NewClamd(address)
+
+	results, err := c.ContScanFileAll("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[1].Path != "/srv/b" || results[1].Status != RES_FOUND {
+		t.Fatalf("got %v", results)
+	}
+
+	if v, err := c.Version(); err != nil || v.DatabaseVersion != 27000 {
+		t.Fatalf("got %+v, %v", v, err)
+	}
+}
+
+func TestPipeFlow(t *testing.T) {
+	var dials int32
+	dialer := pipeDialer(func(conn net.Conn) {
+		atomic.AddInt32(&dials, 1)
+
+		r := bufio.NewReader(conn)
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.TrimPrefix(strings.TrimRight(line, "\n"), "n"); {
+		case command == CMD_PING:
+			io.WriteString(conn, RES_PONG+"\n")
+		case command == CMD_INSTREAM:
+			if data, err := readChunks(r); err == nil && bytes.Contains(data, EICAR) {
+				io.WriteString(conn, "stream: "+EICAR_SIGNATURE+" FOUND\n")
+			}
+		case strings.HasPrefix(command, CMD_SCAN+" "):
+			io.WriteString(conn, strings.TrimPrefix(command, CMD_SCAN+" ")+": OK\n")
+		}
+	})
+
+	c := NewClamdWithOptions("tcp://clamd.invalid:3310", WithDialer(dialer))
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.ScanFileResult("/srv/a")
+	if err != nil || res.Path != "/srv/a" || res.Status != RES_OK {
+		t.Fatalf("SCAN: got %+v, %v", res, err)
+	}
+
+	ok, signature, err := c.ScanStreamClean(bytes.NewReader(EICAR))
+	if ok || signature != EICAR_SIGNATURE || err != nil {
+		t.Fatalf("INSTREAM: got %v, %q, %v", ok, signature, err)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("%d dials, want every command through the dialer", n)
+	}
+}
+
+func TestScanStreamDataWithEOF(t *testing.T) {
+	received := make(chan []byte, 1)
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		data, _ := readChunks(r)
+		received <- data
+
+		io.WriteString(conn, "stream: OK\n")
+	})
+
+	data := append(bytes.Repeat([]byte("x"), CHUNK_SIZE+10), "tail"...)
+
+	// DataErrReader returns the last bytes together with io.EOF.
+	if _, err := collectResults(NewClamd(address).ScanStream(iotest.DataErrReader(bytes.NewReader(data)), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Fatalf("clamd got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+/*
+Read INSTREAM chunks up to the terminating zero-length chunk without keeping
+them, so benchmarks measure the client's allocations rather than the server's.
+*/
+func discardChunks(r *bufio.Reader) error {
+	var header [4]byte
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(header[:])
+		if size == 0 {
+			return nil
+		}
+
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Start a fake clamd answering OK to every INSTREAM.
+*/
+func discardingClamd(b *testing.B) string {
+	return fakeClamd(b, func(command string, r *bufio.Reader, conn net.Conn) {
+		if discardChunks(r) == nil {
+			io.WriteString(conn, "stream: OK\n")
+		}
+	})
+}
+
+/*
+The chunk buffer is reused, so allocations per scan stay the same however
+large the stream is.
+*/
+func BenchmarkScanStream(b *testing.B) {
+	c := NewClamd(discardingClamd(b))
+
+	for _, size := range []int{64 << 10, 1 << 20, 16 << 20} {
+		data := make([]byte, size)
+
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+
+			for i := 0; i < b.N; i++ {
+				if _, err := collectResults(c.ScanStream(bytes.NewReader(data), nil)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseResultPathWithColons(t *testing.T) {
+	tests := []struct {
+		line string
+		path string
+		desc string
+	}{
+		{"/srv/a: b/c.txt: Win.Test.EICAR_HDB-1 FOUND", "/srv/a: b/c.txt", "Win.Test.EICAR_HDB-1"},
+		{"/srv/a: b/c.txt: OK", "/srv/a: b/c.txt", ""},
+		{"/srv/a: b/c.txt: Access denied. ERROR", "/srv/a: b/c.txt", "Access denied."},
+		{"/srv/a: b/c.txt: lstat() failed: No such file or directory. ERROR", "/srv/a: b/c.txt", "lstat() failed: No such file or directory."},
+		{"/srv/x: lstat() failed: Permission denied. ERROR", "/srv/x", "lstat() failed: Permission denied."},
+		{"/srv/a: b/cache: Excluded", "/srv/a: b/cache", ""},
+	}
+
+	for _, tt := range tests {
+		res := parseResult(tt.line)
+		if res.Path != tt.path || res.Description != tt.desc {
+			t.Errorf("%q: got path %q, description %q; want %q, %q", tt.line, res.Path, res.Description, tt.path, tt.desc)
+		}
+	}
+
+	// Below a directory without a colon, as CONTSCAN reports them.
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: b/c.txt: Win.Test.EICAR_HDB-1 FOUND\n/srv/a: b/d.txt: OK\n")
+	})
+
+	results, err := NewClamd(address).ContScanFileAll("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].Path != "/srv/a: b/c.txt" || results[1].Path != "/srv/a: b/d.txt" {
+		t.Fatalf("got %v", results)
+	}
+}
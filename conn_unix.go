@@ -0,0 +1,51 @@
+//go:build unix
+
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+/*
+Pass the descriptor of f to clamd as SCM_RIGHTS ancillary data.
+*/
+func (conn *CLAMDConn) sendFile(f *os.File) error {
+	uc, ok := conn.Conn.(*net.UnixConn)
+	if !ok {
+		return ErrFILDESUnsupported
+	}
+
+	// WriteMsgUnix bypasses Write, so the write timeout is set here.
+	conn.SetWriteDeadline(conn.deadlineAfter(conn.writeTimeout))
+
+	rights := syscall.UnixRights(int(f.Fd()))
+	_, _, err := uc.WriteMsgUnix([]byte{0}, rights, nil)
+	return err
+}
@@ -0,0 +1,3 @@
+module github.com/dutchcoders/go-clamd
+
+go 1.21
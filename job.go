@@ -0,0 +1,325 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+A ScanJob scans a directory tree in the background, delivering a result per
+file on Results and keeping count of its progress. When clamd shares the
+client's filesystem the tree is scanned with CONTSCAN; otherwise it is walked
+on the client and every file streamed to clamd.
+
+The job runs until the tree is done or its context is cancelled, and can be
+paused in between. Results must be received until the channel is closed, after
+which Wait returns the totals.
+*/
+type ScanJob struct {
+	c    *Clamd
+	root string
+
+	results chan *ScanResult
+	done    chan struct{}
+
+	mu       sync.Mutex
+	progress ScanProgress
+	resume   chan struct{}
+
+	summary *ScanSummary
+	err     error
+}
+
+/*
+The counts of a ScanJob so far.
+*/
+type ScanProgress struct {
+	Directories int
+	Files       int
+	Infected    int
+	Errors      int
+}
+
+/*
+Start a job scanning root, which is stopped when ctx is done.
+*/
+func (c *Clamd) NewScanJob(ctx context.Context, root string) *ScanJob {
+	j := &ScanJob{
+		c:       c,
+		root:    root,
+		results: make(chan *ScanResult),
+		done:    make(chan struct{}),
+	}
+
+	go j.run(ctx)
+
+	return j
+}
+
+/*
+The results of the job, closed once it has finished.
+*/
+func (j *ScanJob) Results() <-chan *ScanResult {
+	return j.results
+}
+
+/*
+The counts of the job so far; they are final once Results is closed.
+*/
+func (j *ScanJob) Progress() ScanProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.progress
+}
+
+/*
+Stop the job after the file being scanned. With CONTSCAN clamd may give up on
+the connection if the job stays paused for longer than its SendBufTimeout.
+*/
+func (j *ScanJob) Pause() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.resume == nil {
+		j.resume = make(chan struct{})
+	}
+}
+
+/*
+Continue a paused job.
+*/
+func (j *ScanJob) Resume() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.resume != nil {
+		close(j.resume)
+		j.resume = nil
+	}
+}
+
+/*
+Wait for the job to finish and return its totals. The error is ctx.Err() when
+the job was cancelled, or the reason the connection to clamd failed; errors
+clamd reported for files are counted in the totals instead.
+*/
+func (j *ScanJob) Wait() (*ScanSummary, error) {
+	<-j.done
+	return j.summary, j.err
+}
+
+func (j *ScanJob) run(ctx context.Context) {
+	start := j.c.now()
+
+	var lines []string
+	var err error
+
+	if err = j.c.validate(); err == nil {
+		if j.c.sharesFilesystem() {
+			err = j.contScan(ctx, &lines)
+		} else {
+			err = j.walk(ctx)
+		}
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	progress := j.Progress()
+
+	summary := parseSummary(lines, nil, 0)
+	if summary.ScannedDirectories == 0 {
+		summary.ScannedDirectories = progress.Directories
+	}
+
+	summary.ScannedFiles = progress.Files
+	summary.InfectedFiles = progress.Infected
+	summary.Errors = progress.Errors
+
+	if summary.Elapsed == 0 {
+		summary.Elapsed = j.c.since(start)
+	}
+
+	j.summary = summary
+	j.err = err
+
+	close(j.results)
+	close(j.done)
+}
+
+func (j *ScanJob) contScan(ctx context.Context, lines *[]string) error {
+	ch, err := j.c.scanCommand(ctx, CMD_CONTSCAN, j.root, &scanHooks{
+		summary: func(line string) {
+			*lines = append(*lines, line)
+		},
+		skipped: j.count,
+	})
+	if err != nil {
+		return err
+	}
+
+	for res := range ch {
+		// The connection failing is returned by Wait, not counted.
+		if res.Err != nil {
+			err = res.Err
+			continue
+		}
+
+		// Once ctx is done the connection is closed, which ends ch.
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if j.wait(ctx) == nil {
+			j.emit(ctx, res)
+		}
+	}
+
+	return err
+}
+
+func (j *ScanJob) walk(ctx context.Context) error {
+	return filepath.WalkDir(j.root, func(path string, d fs.DirEntry, err error) error {
+		if err := j.wait(ctx); err != nil {
+			return err
+		}
+
+		if err != nil {
+			res := errorResult(err)
+			res.Path = path
+			res.Err = nil
+
+			if !j.emit(ctx, res) {
+				return ctx.Err()
+			}
+
+			return nil
+		}
+
+		if d.IsDir() {
+			j.mu.Lock()
+			j.progress.Directories++
+			j.mu.Unlock()
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			res := errorResult(err)
+			res.Path = path
+			res.Err = nil
+
+			if !j.emit(ctx, res) {
+				return ctx.Err()
+			}
+
+			return nil
+		}
+
+		results, err := collectResults(j.c.ScanStreamContext(ctx, f))
+		f.Close()
+
+		var clamdErr *ClamdError
+		if err != nil && !errors.As(err, &clamdErr) {
+			return err
+		}
+
+		for _, res := range results {
+			res.Path = path
+
+			if j.c.skipClean && res.IsClean() {
+				j.count(res)
+				continue
+			}
+
+			if !j.emit(ctx, res) {
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	})
+}
+
+/*
+Block while the job is paused. Returns ctx.Err() if ctx is done first.
+*/
+func (j *ScanJob) wait(ctx context.Context) error {
+	j.mu.Lock()
+	resume := j.resume
+	j.mu.Unlock()
+
+	if resume == nil {
+		return nil
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Count res and deliver it, unless ctx is done first.
+*/
+func (j *ScanJob) emit(ctx context.Context, res *ScanResult) bool {
+	j.count(res)
+
+	select {
+	case j.results <- res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (j *ScanJob) count(res *ScanResult) {
+	j.mu.Lock()
+	switch res.Status {
+	case RES_FOUND:
+		j.progress.Files++
+		j.progress.Infected++
+	case RES_ERROR:
+		j.progress.Errors++
+	default:
+		j.progress.Files++
+	}
+	j.mu.Unlock()
+}
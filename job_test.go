@@ -0,0 +1,146 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+/*
+A connection on which clamd going away shows as a reset rather than an orderly
+close.
+*/
+type resetConn struct {
+	net.Conn
+}
+
+func (c resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == io.EOF {
+		err = syscall.ECONNRESET
+	}
+
+	return n, err
+}
+
+func TestScanJob(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: OK\n/srv/b: Win.Test.EICAR_HDB-1 FOUND\n/srv/c: Access denied. ERROR\n")
+	})
+
+	j := NewClamd(address).NewScanJob(context.Background(), "/srv")
+
+	var paths []string
+	for res := range j.Results() {
+		paths = append(paths, res.Path)
+	}
+
+	summary, err := j.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) != 3 || paths[2] != "/srv/c" {
+		t.Fatalf("got results for %q", paths)
+	}
+
+	if summary.ScannedFiles != 2 || summary.InfectedFiles != 1 || summary.Errors != 1 {
+		t.Fatalf("got %+v", summary)
+	}
+}
+
+func TestScanJobCancel(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: OK\n")
+
+		// Stall as if scanning a large file.
+		io.Copy(io.Discard, r)
+	})
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := NewClamd(address).NewScanJob(ctx, "/srv")
+
+	if res := <-j.Results(); res == nil || res.Path != "/srv/a" {
+		t.Fatalf("got %+v", res)
+	}
+
+	cancel()
+
+	for range j.Results() {
+	}
+
+	if _, err := j.Wait(); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestScanJobDaemonDrop(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		io.WriteString(conn, "/srv/a: OK\n/srv/b: OK\n")
+	})
+
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return resetConn{conn}, nil
+	}
+
+	j := NewClamdWithOptions(address, WithDialer(dialer)).NewScanJob(context.Background(), "/srv")
+
+	results := 0
+	for res := range j.Results() {
+		if res.Err != nil {
+			t.Fatalf("connection error delivered as a result: %v", res.Err)
+		}
+
+		results++
+	}
+
+	summary, err := j.Wait()
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v, want %v", err, syscall.ECONNRESET)
+	}
+
+	if results != 2 || summary.ScannedFiles != 2 || summary.Errors != 0 {
+		t.Fatalf("got %d results, %+v", results, summary)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+An Option configures a Clamd created by NewClamdWithOptions.
+
+Unless configured otherwise reads and writes never time out and TCP dials give
+up after TCP_TIMEOUT.
+*/
+type Option func(*Clamd)
+
+/*
+Send streams to clamd in chunks of size bytes. Sizes of zero or less fall back
+to CHUNK_SIZE; streaming with a size above MAX_CHUNK_SIZE fails with
+ErrChunkTooLarge.
+*/
+func WithChunkSize(size int) Option {
+	return func(c *Clamd) {
+		c.chunkSize = size
+	}
+}
+
+/*
+Read streamed data through a buffer of n bytes, so that readers that are slow
+per call, such as files, are read in fewer, larger reads than the chunk size.
+*/
+func WithReadAhead(n int) Option {
+	return func(c *Clamd) {
+		c.readAhead = n
+	}
+}
+
+/*
+Give up dialing clamd after d.
+*/
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Clamd) {
+		c.dialTimeout = d
+	}
+}
+
+/*
+Fail a read that receives nothing from clamd for d. The timeout restarts on
+every read, so slow scans that keep reporting results are not interrupted. A
+read that times out fails with ErrReadTimeout.
+*/
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Clamd) {
+		c.readTimeout = d
+	}
+}
+
+/*
+Fail a write to clamd that does not complete within d.
+*/
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Clamd) {
+		c.writeTimeout = d
+	}
+}
+
+/*
+Connect to clamd over TLS, e.g. when it sits behind stunnel. Applies to TCP
+addresses; tls://host:port addresses use TLS even without this option.
+*/
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Clamd) {
+		c.tlsConfig = cfg
+	}
+}
+
+/*
+Make up to attempts dials before giving up on reaching clamd, e.g. while it
+reloads its database and briefly refuses connections. The wait between dials
+starts at backoff and doubles after each failure. Only dialing is retried,
+never a command or scan once connected.
+*/
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(c *Clamd) {
+		c.retryAttempts = attempts
+		c.retryBackoff = backoff
+	}
+}
+
+/*
+Expect SelfTest to report EICAR as signature instead of EICAR_SIGNATURE, e.g.
+Win.Test.EICAR_HDB-1 on newer signature databases.
+*/
+func WithEICARSignature(signature string) Option {
+	return func(c *Clamd) {
+		c.eicarSignature = signature
+	}
+}
+
+/*
+Send commands with the z prefix, terminated by NUL instead of newline; clamd
+then terminates its replies with NUL too. By default the n prefix is used.
+Either way every command on a connection, including within a Session, uses
+the same prefix.
+*/
+func WithNullTerminator() Option {
+	return func(c *Clamd) {
+		c.nullTerminated = true
+	}
+}
+
+/*
+End n prefixed commands with terminator, e.g. "\r\n" for clamd-compatible
+services that expect Windows line endings, instead of a newline. Replies may
+end in either. Has no effect with WithNullTerminator.
+*/
+func WithCommandTerminator(terminator string) Option {
+	return func(c *Clamd) {
+		c.terminator = terminator
+	}
+}
+
+/*
+Tell the client the StreamMaxLength configured in clamd.conf, which clamd does
+not report itself. Streams whose size is known before reading, such as
+*os.File, *bytes.Reader or *strings.Reader, are then rejected with
+ErrStreamSizeExceeded before anything is sent.
+*/
+func WithStreamMaxLength(n int64) Option {
+	return func(c *Clamd) {
+		c.streamMaxLength = n
+	}
+}
+
+/*
+Send TCP keepalive probes every d, so idle connections such as long-lived
+sessions are not silently dropped by firewalls. Has no effect on Unix sockets.
+*/
+func WithTCPKeepAlive(d time.Duration) Option {
+	return func(c *Clamd) {
+		c.keepAlive = d
+	}
+}
+
+/*
+Call fn after every scan with what was scanned, how long it took and the
+results, e.g. to record metrics. That includes scans run within a Session or
+SessionPool and with ScanStreamWriter. fn runs once the results have been read
+from the scan's channel and must not block for long.
+*/
+func WithOnScanComplete(fn func(ScanEvent)) Option {
+	return func(c *Clamd) {
+		c.onScanComplete = fn
+	}
+}
+
+/*
+Name the service the client belongs to, reported as the Client of every
+ScanEvent, to attribute scans on a clamd shared by many services. clamd itself
+has no command to identify a client by, so this is only seen by the hook; the
+LocalAddr of an event is what clamd's own logs can be matched against.
+*/
+func WithClientID(id string) Option {
+	return func(c *Clamd) {
+		c.clientID = id
+	}
+}
+
+/*
+Dial clamd with d instead of the standard dialer, e.g. to go through a SOCKS
+proxy or to connect to an in-memory fake in tests. d is called with the network
+("tcp" or "unix") and address parsed from the client's address; for tls://
+addresses the TLS handshake is done over the connection d returns.
+*/
+func WithDialer(d func(ctx context.Context, network, address string) (net.Conn, error)) Option {
+	return func(c *Clamd) {
+		c.dialer = d
+	}
+}
+
+/*
+Fail over to addresses, tried in order, when clamd can't be reached at the
+client's own address, e.g. a remote daemon behind a local Unix socket. Only
+connection errors move on to the next address; a command that reached clamd is
+not repeated elsewhere, whatever it replies. ScanEvent reports the address each
+scan ran on. Choices that depend on where clamd runs, such as streaming files
+instead of scanning them by path, are still made for the client's own address.
+*/
+func WithFallbackAddresses(addresses ...string) Option {
+	return func(c *Clamd) {
+		for _, address := range addresses {
+			network, address := parseAddress(address)
+			c.fallbacks = append(c.fallbacks, endpoint{network: network, address: address})
+		}
+	}
+}
+
+/*
+Copy every line clamd replies with to w, newline terminated and before it is
+parsed, e.g. for an audit trail of verdicts alongside the structured results.
+Lines from concurrent commands are written whole, one at a time. Errors
+writing to w are ignored.
+*/
+func WithRawResponse(w io.Writer) Option {
+	return func(c *Clamd) {
+		c.rawResponse = w
+	}
+}
+
+/*
+Trace the protocol through logf, e.g. log.Printf: every command sent and every
+line received from clamd is logged. Scanned data is not.
+*/
+func WithLogger(logf func(format string, args ...any)) Option {
+	return func(c *Clamd) {
+		c.logf = logf
+	}
+}
+
+/*
+Expect response instead of PONG as the reply to PING, for proxies that rewrite
+it.
+*/
+func WithPingResponse(response string) Option {
+	return func(c *Clamd) {
+		c.pingResponse = response
+	}
+}
+
+/*
+Accept any reply to PING that isn't an error as a sign clamd is alive, for
+gateways in front of clamd that answer PING in their own way.
+*/
+func WithLenientPing() Option {
+	return func(c *Clamd) {
+		c.lenientPing = true
+	}
+}
+
+/*
+Don't reuse pooled sessions that have been idle for longer than d. Set it below
+the IdleTimeout in clamd.conf, after which clamd closes idle sessions.
+*/
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Clamd) {
+		c.idleTimeout = d
+	}
+}
+
+/*
+Check pooled sessions with PING before reusing them, replacing those that no
+longer answer.
+*/
+func WithPingOnReuse() Option {
+	return func(c *Clamd) {
+		c.pingOnReuse = true
+	}
+}
+
+/*
+Fail reading a reply line from clamd once it is longer than n bytes, instead of
+buffering it whole, to bound memory when talking to clamd over an untrusted
+network. The default is MAX_LINE_LENGTH.
+*/
+func WithMaxResponseLineLength(n int) Option {
+	return func(c *Clamd) {
+		c.maxLineLength = n
+	}
+}
+
+/*
+Leave clean results out of path scans and ScanJobs, so scanning large trees
+only yields the files that were infected or failed. Scan totals still count
+the files that were skipped.
+*/
+func WithSkipClean() Option {
+	return func(c *Clamd) {
+		c.skipClean = true
+	}
+}
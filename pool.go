@@ -0,0 +1,241 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+A SessionPool keeps Sessions open for reuse, so callers scanning many files or
+streams don't pay for a new connection and IDSESSION every time. It is safe for
+concurrent use.
+
+clamd drops sessions that sit idle for longer than its IdleTimeout, so sessions
+idle for longer than the WithIdleTimeout of the client are closed instead of
+reused, and with WithPingOnReuse every session is checked with PING before it
+is handed out again. Sessions that fail either check are replaced with new ones.
+*/
+type SessionPool struct {
+	c    *Clamd
+	size int
+
+	mu     sync.Mutex
+	idle   []pooledSession
+	closed bool
+}
+
+type pooledSession struct {
+	s        *Session
+	lastUsed time.Time
+}
+
+/*
+Create a pool keeping up to size idle sessions open.
+*/
+func (c *Clamd) NewSessionPool(size int) *SessionPool {
+	return &SessionPool{c: c, size: size}
+}
+
+/*
+Take a session from the pool, opening a new one if no idle session is usable.
+It must be handed back with Put, or closed.
+*/
+func (p *SessionPool) Get() (*Session, error) {
+	return p.GetContext(context.Background())
+}
+
+/*
+GetContext is Get giving up once ctx is done.
+*/
+func (p *SessionPool) GetContext(ctx context.Context) (*Session, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return p.open(ctx)
+		}
+
+		ps := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.c.idleTimeout > 0 && p.c.since(ps.lastUsed) > p.c.idleTimeout {
+			ps.s.Close()
+			continue
+		}
+
+		if p.c.pingOnReuse {
+			if err := ps.s.Ping(); err != nil {
+				ps.s.Close()
+				continue
+			}
+		}
+
+		return ps.s, nil
+	}
+}
+
+/*
+Open a new session, waiting for it no longer than ctx. The session outlives
+ctx, so one that opens after ctx is done is kept for the next caller.
+*/
+func (p *SessionPool) open(ctx context.Context) (*Session, error) {
+	type opened struct {
+		s   *Session
+		err error
+	}
+
+	ch := make(chan opened, 1)
+	go func() {
+		s, err := p.c.NewSession()
+		ch <- opened{s, err}
+	}()
+
+	select {
+	case o := <-ch:
+		return o.s, o.err
+	case <-ctx.Done():
+		go func() {
+			if o := <-ch; o.err == nil {
+				p.Put(o.s)
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+/*
+Return a session taken with Get to the pool. Sessions that are closed or
+broken, or that don't fit in the pool, are not kept.
+*/
+func (p *SessionPool) Put(s *Session) {
+	s.mu.Lock()
+	unusable := s.usable() != nil
+	s.mu.Unlock()
+
+	if unusable {
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size {
+		p.mu.Unlock()
+		s.Close()
+		return
+	}
+
+	p.idle = append(p.idle, pooledSession{s: s, lastUsed: p.c.now()})
+	p.mu.Unlock()
+}
+
+/*
+Scan a file with a pooled session, as Session.ScanFile does.
+*/
+func (p *SessionPool) ScanFile(path string) (*ScanResult, error) {
+	return p.ScanFileContext(context.Background(), path)
+}
+
+/*
+ScanFileContext is ScanFile giving up on waiting for a session once ctx is
+done.
+*/
+func (p *SessionPool) ScanFileContext(ctx context.Context, path string) (*ScanResult, error) {
+	return p.do(ctx, func(s *Session) (*ScanResult, error) {
+		return s.ScanFile(path)
+	})
+}
+
+/*
+Stream r to clamd with a pooled session, as Session.ScanStream does.
+*/
+func (p *SessionPool) ScanStream(r io.Reader) (*ScanResult, error) {
+	return p.ScanStreamContext(context.Background(), r)
+}
+
+/*
+ScanStreamContext is ScanStream giving up on waiting for a session once ctx is
+done.
+*/
+func (p *SessionPool) ScanStreamContext(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	return p.do(ctx, func(s *Session) (*ScanResult, error) {
+		return s.ScanStream(r)
+	})
+}
+
+/*
+Run fn with a pooled session. The session goes back to the pool unless fn left
+it broken, failing part way through a send or reply; errors from before
+anything was sent, or reported by clamd, leave it in step.
+*/
+func (p *SessionPool) do(ctx context.Context, fn func(s *Session) (*ScanResult, error)) (*ScanResult, error) {
+	s, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		p.Put(s)
+		return nil, err
+	}
+
+	res, err := fn(s)
+	p.Put(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+/*
+Close the idle sessions and stop keeping sessions returned with Put.
+*/
+func (p *SessionPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	var err error
+	for _, ps := range idle {
+		if cerr := ps.s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
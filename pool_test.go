@@ -0,0 +1,191 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPoolReplacesSessionsClosedByClamd(t *testing.T) {
+	var sessions int32
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		if command != CMD_IDSESSION {
+			return
+		}
+
+		atomic.AddInt32(&sessions, 1)
+
+		// Like clamd with a short IdleTimeout, drop sessions left idle.
+		for id := 1; ; id++ {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			command := strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "n")
+			switch command {
+			case CMD_END:
+				return
+			case CMD_PING:
+				fmt.Fprintf(conn, "%d: %s\n", id, RES_PONG)
+			default:
+				fmt.Fprintf(conn, "%d: /x: OK\n", id)
+			}
+		}
+	})
+
+	p := NewClamdWithOptions(address, WithPingOnReuse()).NewSessionPool(1)
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if res, err := p.ScanFile("/x"); err != nil || res.Status != RES_OK {
+			t.Fatalf("scan %d: got %v, %v", i, res, err)
+		}
+
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&sessions); n != 3 {
+		t.Fatalf("%d sessions opened, want every dropped session replaced", n)
+	}
+}
+
+func TestPoolKeepsSessionsInStep(t *testing.T) {
+	var sessions int32
+	address := fakeSessions(t, &sessions, func(command string) string {
+		if strings.HasSuffix(command, "/missing") {
+			return "/missing: lstat() failed: No such file or directory. ERROR"
+		}
+
+		return "/x: OK"
+	})
+
+	p := NewClamdWithOptions(address, WithStreamMaxLength(4)).NewSessionPool(1)
+	defer p.Close()
+
+	if _, err := p.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither an error reported by clamd nor one found before sending
+	// anything costs the session.
+	p.ScanFile("/missing")
+
+	if _, err := p.ScanStream(strings.NewReader("too long")); !errors.Is(err, ErrStreamSizeExceeded) {
+		t.Fatalf("got %v, want ErrStreamSizeExceeded", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := p.ScanFileContext(ctx, "/x"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	if _, err := p.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&sessions); n != 1 {
+		t.Fatalf("%d sessions opened, want 1", n)
+	}
+
+	// A stream failing part way leaves the session out of step.
+	if _, err := p.ScanStream(io.MultiReader(strings.NewReader("ab"), iotest.ErrReader(errors.New("read failed")))); err == nil {
+		t.Fatal("failed stream scanned")
+	}
+
+	if _, err := p.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&sessions); n != 2 {
+		t.Fatalf("%d sessions opened, want the broken one replaced", n)
+	}
+}
+
+func TestPoolGetContext(t *testing.T) {
+	var sessions int32
+	address := fakeSessions(t, &sessions, func(command string) string { return "/x: OK" })
+
+	release := make(chan struct{})
+	c := NewClamdWithOptions(address, WithDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-release
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}))
+
+	p := c.NewSessionPool(1)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.GetContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// The session still being opened is kept for the next caller.
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		idle := len(p.idle)
+		p.mu.Unlock()
+
+		if idle == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("session opened late not pooled")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := p.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&sessions); n != 1 {
+		t.Fatalf("%d sessions opened, want 1", n)
+	}
+}
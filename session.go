@@ -0,0 +1,384 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionClosed is returned by commands on a Session that was closed, or
+// whose connection was dropped after a command failed part way through.
+var ErrSessionClosed = errors.New("clamd: session closed")
+
+/*
+A Session runs many commands over a single connection using IDSESSION, instead
+of dialing clamd for every command. Replies are tagged by clamd with the number
+of the command they answer, which the session checks before returning them.
+
+Each command is expected to produce a single reply line, so directory scans
+that report many files should still use the Clamd methods. A Session is safe
+for concurrent use; commands are sent one at a time. Once a command fails part
+way, e.g. the reader of a stream returns an error, the connection is closed and
+later commands return ErrSessionClosed.
+*/
+type Session struct {
+	c *Clamd
+
+	mu     sync.Mutex
+	conn   *CLAMDConn
+	reader *bufio.Reader
+	id     int
+	closed bool
+
+	// broken is set once a command failed part way, leaving the connection
+	// out of step with clamd; it is closed and not used again.
+	broken bool
+
+	// stopKeepalive ends the loop started by Keepalive, if any.
+	stopKeepalive chan struct{}
+}
+
+/*
+Open a connection to clamd and start an IDSESSION on it. The session must be
+closed with Close once it is no longer needed.
+*/
+func (c *Clamd) NewSession() (*Session, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	conn, err := c.openSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		c:      c,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	c.mu.Lock()
+	if c.sessions == nil {
+		c.sessions = map[*Session]struct{}{}
+	}
+	c.sessions[s] = struct{}{}
+	c.mu.Unlock()
+
+	return s, nil
+}
+
+func (c *Clamd) openSession() (*CLAMDConn, error) {
+	conn, err := c.newConnection(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.sendCommand(CMD_IDSESSION); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+/*
+Keep the session from being dropped for idleness by clamd's IdleTimeout,
+sending PING within it every interval. Should clamd have dropped the session
+anyway, a new one is started in its place, so the next command finds a working
+connection. Calling Keepalive again changes the interval; an interval of zero or
+less stops it, as does Close.
+*/
+func (s *Session) Keepalive(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+
+	if interval <= 0 || s.closed {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stopKeepalive = stop
+
+	go func() {
+		clock := s.c.getClock()
+
+		for {
+			select {
+			case <-clock.After(interval):
+			case <-stop:
+				return
+			}
+
+			if err := s.Ping(); err != nil {
+				s.reconnect()
+			}
+		}
+	}()
+}
+
+/*
+Replace a connection clamd dropped with a new session. Commands are numbered
+afresh on it.
+*/
+func (s *Session) reconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	conn, err := s.c.openSession()
+	if err != nil {
+		return err
+	}
+
+	s.conn.Close()
+
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.id = 0
+	s.broken = false
+
+	return nil
+}
+
+/*
+The address of clamd as seen by the session's connection.
+*/
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.RemoteAddr()
+}
+
+/*
+The local address of the session's connection.
+*/
+func (s *Session) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.LocalAddr()
+}
+
+/*
+Read the reply to the last command sent and check it carries its id.
+*/
+func (s *Session) readReply() (*ScanResult, error) {
+	line, err := s.conn.readLine(s.reader)
+	if err := replyError(line); err != nil {
+		return nil, err
+	}
+
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, s.conn.readError(err)
+	}
+
+	parts := strings.SplitN(line, ": ", 2)
+	if len(parts) != 2 {
+		return nil, errors.New(fmt.Sprintf("Invalid response, got %s.", line))
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id != s.id {
+		return nil, errors.New(fmt.Sprintf("Unexpected reply for command %d, got %s.", s.id, line))
+	}
+
+	if err := replyError(parts[1]); err != nil {
+		return nil, err
+	}
+
+	return parseResult(parts[1]), nil
+}
+
+/*
+Whether commands may still be sent. Must be called with s.mu held.
+*/
+func (s *Session) usable() error {
+	if s.closed || s.broken {
+		return ErrSessionClosed
+	}
+
+	return nil
+}
+
+/*
+Give up on the connection after a failed send or reply: clamd may still be
+waiting for the rest of a stream, or have a reply pending, so whatever is sent
+next would be taken for something else. Must be called with s.mu held.
+*/
+func (s *Session) fail(err error) error {
+	s.broken = true
+	s.conn.Close()
+
+	return err
+}
+
+/*
+Send command and read its reply, recording the connection in event if set.
+*/
+func (s *Session) command(command string, event *ScanEvent) (*ScanResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+
+	s.id++
+
+	if event != nil {
+		event.connected(s.conn)
+	}
+
+	if err := s.conn.sendCommand(command); err != nil {
+		return nil, s.fail(err)
+	}
+
+	res, err := s.readReply()
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	return res, nil
+}
+
+/*
+Check the daemon's state within the session (should reply with PONG).
+*/
+func (s *Session) Ping() error {
+	res, err := s.command(CMD_PING, nil)
+	if err != nil {
+		return err
+	}
+
+	if !s.c.isPong(res.Raw) {
+		return errors.New(fmt.Sprintf("Invalid response, got %s.", res.Raw))
+	}
+
+	return nil
+}
+
+/*
+Scan a file within the session (a full path is required).
+*/
+func (s *Session) ScanFile(path string) (*ScanResult, error) {
+	event := ScanEvent{Command: CMD_SCAN, Path: path}
+	start := s.c.now()
+
+	res, err := s.command(CMD_SCAN+" "+s.c.mapPath(path), &event)
+	return s.c.observeResult(context.Background(), event, start, res, err)
+}
+
+/*
+Stream r to clamd within the session, as Clamd.ScanStream does.
+*/
+func (s *Session) ScanStream(r io.Reader) (*ScanResult, error) {
+	if err := s.c.checkStreamSize(r); err != nil {
+		return nil, err
+	}
+
+	event := ScanEvent{Command: CMD_INSTREAM}
+	start := s.c.now()
+
+	res, err := s.scanStream(r, &event)
+	return s.c.observeResult(context.Background(), event, start, res, err)
+}
+
+func (s *Session) scanStream(r io.Reader, event *ScanEvent) (*ScanResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+
+	s.id++
+
+	event.connected(s.conn)
+
+	sent, err := s.conn.sendStream(context.Background(), s.c.readAheadReader(r), s.c.streamChunkSize())
+	event.BytesSent = sent
+
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	res, err := s.readReply()
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	return res, nil
+}
+
+/*
+End the session and close its connection.
+*/
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+
+	s.c.mu.Lock()
+	delete(s.c.sessions, s)
+	s.c.mu.Unlock()
+
+	// A broken session's connection is closed already.
+	if s.broken {
+		return nil
+	}
+
+	s.conn.sendCommand(CMD_END)
+	return s.conn.Close()
+}
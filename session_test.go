@@ -0,0 +1,140 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSessionScansReportEvents(t *testing.T) {
+	address := fakeSessions(t, nil, func(command string) string {
+		switch command {
+		case CMD_PING:
+			return RES_PONG
+		case CMD_INSTREAM:
+			return "stream: OK"
+		}
+
+		return "/x: OK"
+	})
+
+	var mu sync.Mutex
+	var events []ScanEvent
+
+	c := NewClamdWithOptions(address, WithOnScanComplete(func(e ScanEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ScanStream(strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := c.NewSessionPool(1)
+	defer p.Close()
+
+	if _, err := p.ScanFile("/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{CMD_SCAN, CMD_INSTREAM, CMD_SCAN}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+
+	for i, e := range events {
+		if e.Command != want[i] || len(e.Results) != 1 || e.Err != nil || e.Address != address {
+			t.Fatalf("event %d: %+v", i, e)
+		}
+	}
+
+	if events[1].BytesSent != 4 {
+		t.Fatalf("stream event sent %d bytes, want 4", events[1].BytesSent)
+	}
+}
+
+func TestSessionClosedAfterFailedStream(t *testing.T) {
+	address := fakeSessions(t, nil, func(command string) string {
+		return "/x: OK"
+	})
+
+	s, err := NewClamd(address).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader fails after the first chunk, so clamd is left waiting for
+	// the rest of the stream.
+	failing := io.MultiReader(strings.NewReader("data"), iotest.ErrReader(errors.New("disk error")))
+
+	if _, err := s.ScanStream(failing); err == nil {
+		t.Fatal("failed stream reported as scanned")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if _, err := s.ScanFile("/x"); err != ErrSessionClosed {
+			done <- err
+			return
+		}
+
+		done <- s.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still in use after a failed stream")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var errWriterClosed = errors.New("clamd: write to closed stream writer")
+
+/*
+Scan data that is written rather than read. Writes are sent to clamd in chunks
+with INSTREAM; closing the writer ends the stream, after which the verdict is
+delivered on the returned channel. The writer must be closed, even after a
+failed write, for the channel to be closed. Like most writers it is not safe
+for concurrent use.
+*/
+func (c *Clamd) ScanStreamWriter() (io.WriteCloser, <-chan *ScanResult, error) {
+	return c.ScanStreamWriterContext(context.Background())
+}
+
+/*
+ScanStreamWriterContext is ScanStreamWriter bounded by ctx.
+*/
+func (c *Clamd) ScanStreamWriterContext(ctx context.Context) (io.WriteCloser, <-chan *ScanResult, error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if c.streamChunkSize() > MAX_CHUNK_SIZE {
+		return nil, nil, ErrChunkTooLarge
+	}
+
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := conn.sendCommand(CMD_INSTREAM); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	w := &streamWriter{
+		c:         c,
+		ctx:       ctx,
+		event:     ScanEvent{Command: CMD_INSTREAM},
+		start:     c.now(),
+		conn:      conn,
+		chunkSize: c.streamChunkSize(),
+		results:   make(chan *ScanResult, 1),
+	}
+
+	w.event.connected(conn)
+
+	return w, w.results, nil
+}
+
+type streamWriter struct {
+	c         *Clamd
+	ctx       context.Context
+	event     ScanEvent
+	start     time.Time
+	conn      *CLAMDConn
+	chunkSize int
+	buf       []byte
+	results   chan *ScanResult
+	err       error
+	closed    bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+
+	for len(w.buf) >= w.chunkSize {
+		if err := w.conn.sendChunk(w.buf[:w.chunkSize]); err != nil {
+			w.err = w.conn.writeError(w.ctx, err)
+			return 0, w.err
+		}
+
+		w.event.BytesSent += int64(w.chunkSize)
+
+		w.buf = w.buf[w.chunkSize:]
+	}
+
+	return len(p), nil
+}
+
+/*
+Send what is left of the stream and the terminating chunk, and start reading
+the verdict.
+*/
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return errWriterClosed
+	}
+
+	w.closed = true
+
+	if w.err == nil && len(w.buf) > 0 {
+		if err := w.conn.sendChunk(w.buf); err != nil {
+			w.err = w.conn.writeError(w.ctx, err)
+		} else {
+			w.event.BytesSent += int64(len(w.buf))
+		}
+	}
+
+	if w.err == nil {
+		if err := w.conn.sendEOF(); err != nil {
+			w.err = w.conn.writeError(w.ctx, err)
+		}
+	}
+
+	if w.err != nil {
+		w.conn.Close()
+		w.results <- errorResult(w.err)
+		close(w.results)
+
+		w.event.Err = w.err
+		w.c.report(w.ctx, w.event, w.start)
+		return w.err
+	}
+
+	ch, wg, _ := w.conn.readResponse()
+
+	go func() {
+		for s := range ch {
+			if s.Err != nil {
+				w.event.Err = s.Err
+			}
+
+			w.event.Results = append(w.event.Results, s)
+
+			if !forwardResult(w.ctx, ch, w.results, s) {
+				w.event.Err = w.ctx.Err()
+				break
+			}
+		}
+
+		wg.Wait()
+		w.conn.Close()
+		close(w.results)
+
+		w.c.report(w.ctx, w.event, w.start)
+	}()
+
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestScanStreamWriterReportsEvent(t *testing.T) {
+	address := fakeClamd(t, func(command string, r *bufio.Reader, conn net.Conn) {
+		readChunks(r)
+		io.WriteString(conn, "stream: OK\n")
+	})
+
+	events := make(chan ScanEvent, 1)
+	c := NewClamdWithOptions(address, WithChunkSize(4), WithOnScanComplete(func(e ScanEvent) {
+		events <- e
+	}))
+
+	w, results, err := c.ScanStreamWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(w, "0123456789")
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	DrainResults(results)
+
+	e := <-events
+	if e.Command != CMD_INSTREAM || e.BytesSent != 10 || len(e.Results) != 1 || e.Results[0].Status != RES_OK {
+		t.Fatalf("%+v", e)
+	}
+}